@@ -0,0 +1,231 @@
+package bk
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lysu/beanstalk"
+	"golang.org/x/net/context"
+)
+
+// DefaultHold keeps prepared jobs delayed for good unless confirmed.
+var DefaultHold = 100000 * time.Hour
+
+// Beanstalk prepares messages as jobs delayed by Hold; confirming kicks
+// them and cancelling deletes them.
+type Beanstalk struct {
+	Addr string
+	Hold time.Duration
+	// Tubes are the ones Check goes through.
+	Tubes []string
+	// TTR is used for messages without one.
+	TTR time.Duration
+
+	mu   sync.Mutex
+	conn *beanstalk.Conn
+}
+
+func NewBeanstalk(addr string) *Beanstalk {
+	return &Beanstalk{Addr: addr, Hold: DefaultHold, Tubes: []string{"default"}, TTR: time.Minute}
+}
+
+func (b *Beanstalk) Prepare(msg *Message) (uint64, error) {
+	return b.put(msg, b.Hold)
+}
+
+func (b *Beanstalk) put(msg *Message, delay time.Duration) (uint64, error) {
+	body, err := msg.Encode()
+	if err != nil {
+		return 0, err
+	}
+	ttr := msg.TTR
+	if ttr == 0 {
+		ttr = b.TTR
+	}
+	var id uint64
+	err = b.do(func(conn *beanstalk.Conn) (err error) {
+		tube := &beanstalk.Tube{Conn: conn, Name: tubeName(msg.Tube)}
+		id, err = tube.Put(body, msg.Priority, delay, ttr)
+		return
+	})
+	return id, err
+}
+
+// Confirm treats a job that is neither delayed nor buried as confirmed
+// already.
+func (b *Beanstalk) Confirm(id uint64) error {
+	return b.do(func(conn *beanstalk.Conn) error {
+		if err := conn.KickJob(id); err != nil && !isNotFound(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+func (b *Beanstalk) Cancel(id uint64) error {
+	return b.do(func(conn *beanstalk.Conn) error {
+		if err := conn.Delete(id); err != nil && !isNotFound(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// Check goes through the held jobs of Tubes. Beanstalkd only shows the
+// delayed job due first, so a tube is checked up to its first job that is
+// not held or younger than age; jobs of unknown status are put again
+// behind the others so they do not hide the ones after them.
+// Transactional messages had better not share tubes with other delayed
+// jobs.
+func (b *Beanstalk) Check(c context.Context, lookup StatusLookup, age time.Duration, n int) (*CheckResult, error) {
+	result := &CheckResult{}
+	for _, name := range b.Tubes {
+		if err := b.checkTube(c, name, lookup, age, n, result); err != nil {
+			return result, errors.Annotatef(err, "tube %s", name)
+		}
+	}
+	return result, nil
+}
+
+func (b *Beanstalk) checkTube(c context.Context, name string, lookup StatusLookup, age time.Duration, n int, result *CheckResult) error {
+	for i := 0; i < n; i++ {
+		var (
+			id    uint64
+			body  []byte
+			stats map[string]string
+		)
+		err := b.do(func(conn *beanstalk.Conn) (err error) {
+			tube := &beanstalk.Tube{Conn: conn, Name: name}
+			if id, body, err = tube.PeekDelayed(); err != nil {
+				return
+			}
+			stats, err = conn.StatsJob(id)
+			return
+		})
+		if isNotFound(err) {
+			// Nothing delayed, or settled in between.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if statInt(stats, "delay") < int64(b.Hold/time.Second) ||
+			statInt(stats, "age") < int64(age/time.Second) {
+			return nil
+		}
+		status := TX_UNKNOWN
+		if msg, err := Decode(id, body); err == nil {
+			msg.Tube = name
+			if status, err = lookup(c, msg); err != nil {
+				return errors.Annotatef(err, "look up job %d", id)
+			}
+		}
+		switch status {
+		case TX_COMMITTED:
+			if err = b.Confirm(id); err == nil {
+				result.Kicked++
+			}
+		case TX_ROLLED_BACK:
+			if err = b.Cancel(id); err == nil {
+				result.Deleted++
+			}
+		default:
+			if err = b.requeue(name, id, body, stats); err == nil {
+				result.Requeued++
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requeue puts a copy of the job before deleting it, so it is never lost;
+// the copy goes again if the sender settled the original meanwhile. A
+// sender settling the original later misses it, and leaves the copy to a
+// later sweep.
+func (b *Beanstalk) requeue(name string, id uint64, body []byte, stats map[string]string) error {
+	return b.do(func(conn *beanstalk.Conn) error {
+		tube := &beanstalk.Tube{Conn: conn, Name: name}
+		ttr := time.Duration(statInt(stats, "ttr")) * time.Second
+		copyID, err := tube.Put(body, uint32(statInt(stats, "pri")), b.Hold, ttr)
+		if err != nil {
+			return err
+		}
+		if err = conn.Delete(id); isNotFound(err) {
+			return conn.Delete(copyID)
+		}
+		return err
+	})
+}
+
+func (b *Beanstalk) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn = nil
+	return errors.Trace(err)
+}
+
+// do runs f on the shared connection, dialing it when needed and dropping
+// it when f fails for anything but a beanstalkd reply.
+func (b *Beanstalk) do(f func(conn *beanstalk.Conn) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		conn, err := beanstalk.Dial("tcp", b.Addr)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		b.conn = conn
+	}
+	err := f(b.conn)
+	if err != nil && !isReply(err) {
+		b.conn.Close()
+		b.conn = nil
+	}
+	return errors.Trace(err)
+}
+
+var replyErrs = []error{
+	beanstalk.ErrBadFormat, beanstalk.ErrBuried, beanstalk.ErrDeadline, beanstalk.ErrDraining,
+	beanstalk.ErrInternal, beanstalk.ErrJobTooBig, beanstalk.ErrNoCRLF, beanstalk.ErrNotFound,
+	beanstalk.ErrNotIgnored, beanstalk.ErrOOM, beanstalk.ErrTimeout, beanstalk.ErrUnknown,
+}
+
+// isReply tells errors beanstalkd answered with from broken connections.
+func isReply(err error) bool {
+	cerr, ok := errors.Cause(err).(beanstalk.ConnError)
+	if !ok {
+		return false
+	}
+	for _, e := range replyErrs {
+		if cerr.Err == e {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotFound(err error) bool {
+	cerr, ok := errors.Cause(err).(beanstalk.ConnError)
+	return ok && cerr.Err == beanstalk.ErrNotFound
+}
+
+func statInt(stats map[string]string, key string) int64 {
+	n, _ := strconv.ParseInt(stats[key], 10, 64)
+	return n
+}
+
+func tubeName(name string) string {
+	if name == "" {
+		return "default"
+	}
+	return name
+}
@@ -0,0 +1,47 @@
+package bk_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lysu/beanstalk"
+	"github.com/lysu/go-misc/bk"
+	"github.com/lysu/go-misc/bk/bktest"
+)
+
+func TestBeanstalkBackend(t *testing.T) {
+	bktest.RunBackendTests(t, func(t *testing.T) *bktest.Harness {
+		s, err := bktest.NewServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		backend := bk.NewBeanstalk(s.Addr)
+		backend.Tubes = []string{"jobs"}
+		t.Cleanup(func() { backend.Close() })
+		conn, err := beanstalk.Dial("tcp", s.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		jobs := beanstalk.NewTubeSet(conn, "jobs")
+		return &bktest.Harness{
+			Backend: backend,
+			Tube:    "jobs",
+			Delivered: func() []*bk.Message {
+				var msgs []*bk.Message
+				for {
+					id, body, err := jobs.Reserve(0)
+					if err != nil {
+						return msgs
+					}
+					conn.Delete(id)
+					if msg, err := bk.Decode(id, body); err == nil {
+						msgs = append(msgs, msg)
+					}
+				}
+			},
+			Advance: func(d time.Duration) { s.Advance(d) },
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package bk
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"golang.org/x/net/context"
+)
+
+// Message is what SendInTx publishes. Only MsgID, Key and Body travel to
+// the consumer; the rest tells the backend how to queue it.
+type Message struct {
+	// ID is set by the backend once the message is prepared.
+	ID uint64 `json:"-"`
+	// MsgID stays the same across retries and requeues, unlike ID.
+	// SendInTx fills in a random one when empty.
+	MsgID string `json:"msg_id,omitempty"`
+	Key   string `json:"key"`
+	Body  []byte `json:"body"`
+
+	Tube     string        `json:"-"`
+	Priority uint32        `json:"-"`
+	TTR      time.Duration `json:"-"`
+}
+
+func (m *Message) Encode() ([]byte, error) {
+	b, err := json.Marshal(m)
+	return b, errors.Trace(err)
+}
+
+func Decode(id uint64, b []byte) (*Message, error) {
+	m := &Message{ID: id}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, errors.Annotatef(err, "job %d", id)
+	}
+	return m, nil
+}
+
+// Backend holds prepared messages back from consumers until they are
+// confirmed, and drops them when cancelled. Confirm and Cancel must be
+// idempotent as they are retried. bktest.RunBackendTests checks all of
+// this.
+type Backend interface {
+	Prepare(msg *Message) (uint64, error)
+	Confirm(id uint64) error
+	Cancel(id uint64) error
+	// Check asks lookup about at most n messages held for longer than age
+	// and settles the ones it knows about.
+	Check(c context.Context, lookup StatusLookup, age time.Duration, n int) (*CheckResult, error)
+}
+
+type Op string
+
+const (
+	OP_CONFIRM Op = "confirm"
+	OP_CANCEL  Op = "cancel"
+)
+
+// Journal keeps the confirms and cancels that failed so they can be
+// retried later.
+type Journal interface {
+	Record(id uint64, op Op) error
+}
+
+// FinishError reports a confirm or cancel that failed and could not be
+// journaled either; the message stays held until someone settles it.
+type FinishError struct {
+	ID         uint64
+	Op         Op
+	Err        error
+	JournalErr error
+}
+
+func (e *FinishError) Error() string {
+	msg := fmt.Sprintf("%s message %d: %v", e.Op, e.ID, e.Err)
+	if e.JournalErr != nil {
+		msg += fmt.Sprintf(" (not journaled: %v)", e.JournalErr)
+	}
+	return msg
+}
+
+func (e *FinishError) Unwrap() error {
+	return e.Err
+}
+
+type Sender struct {
+	Backend Backend
+	Journal Journal
+}
+
+func NewSender(backend Backend, journal Journal) *Sender {
+	return &Sender{Backend: backend, Journal: journal}
+}
+
+// Default is the Sender of the package level SendInTx.
+var Default *Sender
+
+func SendInTx(c context.Context, msg *Message, f func(c context.Context) error, noRollbackErrs ...error) error {
+	if Default == nil {
+		return errors.New("bk.Default is not set")
+	}
+	return Default.SendInTx(c, msg, f, noRollbackErrs...)
+}
+
+// SendInTx prepares msg, runs f in ds.DoTx and then confirms msg if the
+// transaction committed or cancels it otherwise. It refuses to run inside
+// a ds.BindTx transaction, as nothing would tell it that one committed.
+func (s *Sender) SendInTx(c context.Context, msg *Message, f func(c context.Context) error, noRollbackErrs ...error) error {
+	if ds.InBoundTx(c) {
+		return errors.New("SendInTx cannot run in a BindTx transaction")
+	}
+	if msg.MsgID == "" {
+		msg.MsgID = newMsgID()
+	}
+	id, err := s.Backend.Prepare(msg)
+	if err != nil {
+		return errors.Annotate(err, "prepare message")
+	}
+	msg.ID = id
+	var (
+		hooked    bool
+		finishErr error
+	)
+	_, err = ds.DoTx(c, func(c context.Context) (interface{}, error) {
+		if err := ds.AfterTx(c, func(committed bool) {
+			finishErr = s.finish(id, committed)
+		}); err != nil {
+			return nil, err
+		}
+		hooked = true
+		return nil, f(c)
+	}, noRollbackErrs...)
+	if !hooked {
+		// The transaction never started.
+		finishErr = s.finish(id, false)
+	}
+	if err == nil {
+		err = finishErr
+	}
+	return err
+}
+
+func newMsgID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *Sender) finish(id uint64, committed bool) error {
+	op, do := OP_CANCEL, s.Backend.Cancel
+	if committed {
+		op, do = OP_CONFIRM, s.Backend.Confirm
+	}
+	err := do(id)
+	if err == nil {
+		return nil
+	}
+	ferr := &FinishError{ID: id, Op: op, Err: err}
+	if s.Journal == nil {
+		return ferr
+	}
+	if ferr.JournalErr = s.Journal.Record(id, op); ferr.JournalErr != nil {
+		return ferr
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package bk_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lysu/go-misc/bk"
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type fakeBackend struct {
+	next      uint64
+	held      map[uint64]*bk.Message
+	confirmed []uint64
+	cancelled []uint64
+	fail      error
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{held: map[uint64]*bk.Message{}}
+}
+
+func (b *fakeBackend) Prepare(msg *bk.Message) (uint64, error) {
+	b.next++
+	b.held[b.next] = msg
+	return b.next, nil
+}
+
+func (b *fakeBackend) Confirm(id uint64) error {
+	if b.fail != nil {
+		return b.fail
+	}
+	delete(b.held, id)
+	b.confirmed = append(b.confirmed, id)
+	return nil
+}
+
+func (b *fakeBackend) Cancel(id uint64) error {
+	if b.fail != nil {
+		return b.fail
+	}
+	delete(b.held, id)
+	b.cancelled = append(b.cancelled, id)
+	return nil
+}
+
+func (b *fakeBackend) Check(c context.Context, lookup bk.StatusLookup, age time.Duration, n int) (*bk.CheckResult, error) {
+	return &bk.CheckResult{}, nil
+}
+
+type journal map[uint64]bk.Op
+
+func (j journal) Record(id uint64, op bk.Op) error {
+	j[id] = op
+	return nil
+}
+
+func TestSendInTx(t *testing.T) {
+	db := dstest.SQLite(t)
+	db.MustExec("CREATE TABLE orders (id INTEGER PRIMARY KEY, state TEXT)")
+	db.MustExec("INSERT INTO orders VALUES (1, 'new')")
+	backend := newFakeBackend()
+	s := bk.NewSender(backend, nil)
+	c := context.Background()
+	pay := func(c context.Context) error {
+		_, err := ds.Exec(c, "UPDATE orders SET state = 'paid' WHERE id = 1")
+		return err
+	}
+
+	msg := &bk.Message{Key: "order-1", Body: []byte("paid")}
+	assert.NoError(t, s.SendInTx(c, msg, pay))
+	assert.Equal(t, []uint64{msg.ID}, backend.confirmed)
+	assert.Len(t, msg.MsgID, 32)
+
+	boom := errors.New("boom")
+	err := s.SendInTx(c, &bk.Message{Key: "order-1"}, func(c context.Context) error {
+		if err := pay(c); err != nil {
+			return err
+		}
+		return boom
+	})
+	assert.Equal(t, boom, err)
+	assert.Equal(t, []uint64{2}, backend.cancelled)
+	assert.Empty(t, backend.held)
+
+	// Failures to settle go to the journal, or back to the caller without one.
+	backend.fail = errors.New("unreachable")
+	err = s.SendInTx(c, &bk.Message{}, pay)
+	ferr, ok := err.(*bk.FinishError)
+	assert.True(t, ok)
+	assert.Equal(t, bk.OP_CONFIRM, ferr.Op)
+	j := journal{}
+	s.Journal = j
+	assert.NoError(t, s.SendInTx(c, &bk.Message{}, pay))
+	assert.Equal(t, journal{4: bk.OP_CONFIRM}, j)
+	backend.fail = nil
+}
+
+func TestSendInTxBindTx(t *testing.T) {
+	dstest.SQLite(t)
+	backend := newFakeBackend()
+	s := bk.NewSender(backend, nil)
+	c := dstest.Begin(t)
+
+	// Nothing would confirm the message once the bound transaction commits.
+	called := false
+	err := s.SendInTx(c, &bk.Message{}, func(c context.Context) error {
+		called = true
+		return nil
+	})
+	assert.Error(t, err)
+	assert.False(t, called)
+	assert.Empty(t, backend.held)
+}
@@ -0,0 +1,94 @@
+package bktest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lysu/go-misc/bk"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// Harness is what RunBackendTests needs to see of a backend.
+type Harness struct {
+	Backend bk.Backend
+	// Tube is the one the tests send to.
+	Tube string
+	// Delivered returns the messages that reached consumers since the
+	// last call.
+	Delivered func() []*bk.Message
+	// Advance makes held messages d older.
+	Advance func(d time.Duration)
+}
+
+// RunBackendTests checks that a backend holds, confirms, cancels and
+// checks messages the way bk needs. newHarness is called with a fresh
+// backend for every subtest.
+func RunBackendTests(t *testing.T, newHarness func(t *testing.T) *Harness) {
+	t.Run("Confirm", func(t *testing.T) {
+		h := newHarness(t)
+		id, err := h.Backend.Prepare(&bk.Message{MsgID: "m1", Key: "a", Body: []byte("x"), Tube: h.Tube})
+		assert.NoError(t, err)
+		assert.Empty(t, h.Delivered(), "prepared messages are held")
+
+		assert.NoError(t, h.Backend.Confirm(id))
+		msgs := h.Delivered()
+		if assert.Len(t, msgs, 1) {
+			assert.Equal(t, "m1", msgs[0].MsgID)
+			assert.Equal(t, "a", msgs[0].Key)
+			assert.Equal(t, []byte("x"), msgs[0].Body)
+		}
+		assert.NoError(t, h.Backend.Confirm(id), "Confirm is idempotent")
+		assert.NoError(t, h.Backend.Cancel(id), "Cancel after Confirm is a no-op")
+		assert.Empty(t, h.Delivered())
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		h := newHarness(t)
+		id, err := h.Backend.Prepare(&bk.Message{Key: "a", Tube: h.Tube})
+		assert.NoError(t, err)
+		assert.NoError(t, h.Backend.Cancel(id))
+		assert.NoError(t, h.Backend.Cancel(id), "Cancel is idempotent")
+		assert.NoError(t, h.Backend.Confirm(id), "Confirm after Cancel is a no-op")
+		assert.Empty(t, h.Delivered())
+	})
+
+	t.Run("Check", func(t *testing.T) {
+		h := newHarness(t)
+		statuses := map[string]bk.TxStatus{
+			"committed":   bk.TX_COMMITTED,
+			"rolled-back": bk.TX_ROLLED_BACK,
+			"unknown":     bk.TX_UNKNOWN,
+		}
+		for _, key := range []string{"committed", "rolled-back", "unknown"} {
+			_, err := h.Backend.Prepare(&bk.Message{Key: key, Tube: h.Tube})
+			assert.NoError(t, err)
+		}
+		lookup := func(c context.Context, msg *bk.Message) (bk.TxStatus, error) {
+			return statuses[msg.Key], nil
+		}
+		check := func() *bk.CheckResult {
+			result, err := h.Backend.Check(context.Background(), lookup, time.Minute, 10)
+			assert.NoError(t, err)
+			return result
+		}
+		keys := func() []string {
+			var keys []string
+			for _, msg := range h.Delivered() {
+				keys = append(keys, msg.Key)
+			}
+			return keys
+		}
+
+		assert.Equal(t, &bk.CheckResult{}, check(), "young messages are left alone")
+		h.Advance(2 * time.Minute)
+		assert.Equal(t, &bk.CheckResult{Kicked: 1, Deleted: 1, Requeued: 1}, check())
+		assert.Equal(t, []string{"committed"}, keys())
+
+		assert.Equal(t, &bk.CheckResult{}, check(), "requeued messages count as young")
+		statuses["unknown"] = bk.TX_COMMITTED
+		h.Advance(2 * time.Minute)
+		assert.Equal(t, &bk.CheckResult{Kicked: 1}, check())
+		assert.Equal(t, []string{"unknown"}, keys())
+	})
+}
@@ -0,0 +1,761 @@
+package bktest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	READY    = "ready"
+	DELAYED  = "delayed"
+	RESERVED = "reserved"
+	BURIED   = "buried"
+)
+
+// MaxJobSize is the largest body put accepts, as beanstalkd's -z.
+var MaxJobSize = 65535
+
+// Action is what a Hook wants done with a command.
+type Action struct {
+	// Delay is slept before the command runs.
+	Delay time.Duration
+	// Reply, such as "INTERNAL_ERROR", is sent instead of running it.
+	Reply string
+	// Drop closes the connection instead of running it.
+	Drop bool
+}
+
+// Hook sees every command before it runs. cmd is its first word.
+type Hook func(cmd string, args []string) Action
+
+// Server speaks the beanstalkd text protocol from memory. Its clock can be
+// moved with Advance so delays and TTRs pass without sleeping.
+type Server struct {
+	Addr string
+
+	ln      net.Listener
+	mu      sync.Mutex
+	changed chan struct{}
+	offset  time.Duration
+	hook    Hook
+	nextID  uint64
+	jobs    map[uint64]*job
+	tubes   map[string]*tube
+	conns   map[*conn]bool
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+type job struct {
+	id       uint64
+	tube     string
+	pri      uint32
+	delay    time.Duration
+	ttr      time.Duration
+	body     []byte
+	state    string
+	created  time.Time
+	until    time.Time
+	owner    *conn
+	reserves int
+	timeouts int
+	releases int
+	buries   int
+	kicks    int
+}
+
+type tube struct {
+	name       string
+	pausedTill time.Time
+	pause      time.Duration
+	total      int
+	deletes    int
+	pauses     int
+}
+
+type conn struct {
+	nc      net.Conn
+	r       *bufio.Reader
+	use     string
+	watched map[string]bool
+}
+
+// NewServer listens on a random port of 127.0.0.1.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s := &Server{
+		Addr:    ln.Addr().String(),
+		ln:      ln,
+		changed: make(chan struct{}),
+		jobs:    map[uint64]*job{},
+		tubes:   map[string]*tube{},
+		conns:   map[*conn]bool{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) SetHook(hook Hook) {
+	s.mu.Lock()
+	s.hook = hook
+	s.mu.Unlock()
+}
+
+// Advance moves the clock of the server forward by d.
+func (s *Server) Advance(d time.Duration) {
+	s.mu.Lock()
+	s.offset += d
+	s.notify()
+	s.mu.Unlock()
+}
+
+// State returns the state of job id, or "" if there is no such job.
+func (s *Server) State(id uint64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick()
+	if j, ok := s.jobs[id]; ok {
+		return j.state
+	}
+	return ""
+}
+
+// Close stops listening and drops every connection.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	s.notify()
+	s.mu.Unlock()
+	err := s.ln.Close()
+	s.wg.Wait()
+	return errors.Trace(err)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{nc: nc, r: bufio.NewReader(nc), use: "default", watched: map[string]bool{"default": true}}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return
+		}
+		s.conns[c] = true
+		s.tubeOf("default")
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c *conn) {
+	defer s.wg.Done()
+	defer s.disconnect(c)
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if !strings.HasSuffix(line, "\r\n") {
+			c.reply("BAD_FORMAT")
+			continue
+		}
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			c.reply("BAD_FORMAT")
+			continue
+		}
+		cmd, args := words[0], words[1:]
+		var body []byte
+		if cmd == "put" {
+			// The body is read before any hook so the stream stays in sync.
+			if body, err = c.readBody(args); err != nil {
+				if err == io.EOF {
+					return
+				}
+				c.reply(err.Error())
+				continue
+			}
+		}
+		s.mu.Lock()
+		hook := s.hook
+		s.mu.Unlock()
+		if hook != nil {
+			action := hook(cmd, args)
+			if action.Delay > 0 {
+				time.Sleep(action.Delay)
+			}
+			if action.Drop {
+				return
+			}
+			if action.Reply != "" {
+				c.reply(action.Reply)
+				continue
+			}
+		}
+		if cmd == "quit" {
+			return
+		}
+		c.write(s.run(c, cmd, args, body))
+	}
+}
+
+func (c *conn) readBody(args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("BAD_FORMAT")
+	}
+	n, err := strconv.Atoi(args[3])
+	if err != nil || n < 0 {
+		return nil, errors.New("BAD_FORMAT")
+	}
+	body := make([]byte, n+2)
+	if _, err = io.ReadFull(c.r, body); err != nil {
+		return nil, io.EOF
+	}
+	if string(body[n:]) != "\r\n" {
+		return nil, errors.New("EXPECTED_CRLF")
+	}
+	if n > MaxJobSize {
+		return nil, errors.New("JOB_TOO_BIG")
+	}
+	return body[:n], nil
+}
+
+func (c *conn) reply(line string) {
+	c.write(line + "\r\n")
+}
+
+func (c *conn) write(reply string) {
+	io.WriteString(c.nc, reply)
+}
+
+func (s *Server) disconnect(c *conn) {
+	c.nc.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+	for _, j := range s.jobs {
+		if j.state == RESERVED && j.owner == c {
+			j.state, j.owner = READY, nil
+		}
+	}
+	s.notify()
+}
+
+// run executes one command and returns the whole reply.
+func (s *Server) run(c *conn, cmd string, args []string, body []byte) string {
+	if cmd == "reserve" || cmd == "reserve-with-timeout" {
+		return s.reserve(c, cmd, args)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick()
+	switch cmd {
+	case "put":
+		return s.put(c, args, body)
+	case "use":
+		if len(args) != 1 {
+			return "BAD_FORMAT\r\n"
+		}
+		c.use = args[0]
+		s.tubeOf(c.use)
+		return "USING " + c.use + "\r\n"
+	case "watch":
+		if len(args) != 1 {
+			return "BAD_FORMAT\r\n"
+		}
+		c.watched[args[0]] = true
+		s.tubeOf(args[0])
+		return fmt.Sprintf("WATCHING %d\r\n", len(c.watched))
+	case "ignore":
+		if len(args) != 1 {
+			return "BAD_FORMAT\r\n"
+		}
+		if c.watched[args[0]] && len(c.watched) == 1 {
+			return "NOT_IGNORED\r\n"
+		}
+		delete(c.watched, args[0])
+		return fmt.Sprintf("WATCHING %d\r\n", len(c.watched))
+	case "delete":
+		return s.withJob(args, func(j *job) string {
+			if j.state == RESERVED && j.owner != c {
+				return "NOT_FOUND\r\n"
+			}
+			delete(s.jobs, j.id)
+			s.tubeOf(j.tube).deletes++
+			s.notify()
+			return "DELETED\r\n"
+		})
+	case "release":
+		if len(args) != 3 {
+			return "BAD_FORMAT\r\n"
+		}
+		pri, err1 := strconv.ParseUint(args[1], 10, 32)
+		delay, err2 := seconds(args[2])
+		if err1 != nil || err2 != nil {
+			return "BAD_FORMAT\r\n"
+		}
+		return s.withJob(args[:1], func(j *job) string {
+			if j.state != RESERVED || j.owner != c {
+				return "NOT_FOUND\r\n"
+			}
+			j.pri, j.delay, j.owner = uint32(pri), delay, nil
+			j.releases++
+			s.schedule(j)
+			return "RELEASED\r\n"
+		})
+	case "bury":
+		if len(args) != 2 {
+			return "BAD_FORMAT\r\n"
+		}
+		pri, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return "BAD_FORMAT\r\n"
+		}
+		return s.withJob(args[:1], func(j *job) string {
+			if j.state != RESERVED || j.owner != c {
+				return "NOT_FOUND\r\n"
+			}
+			j.pri, j.state, j.owner = uint32(pri), BURIED, nil
+			j.buries++
+			return "BURIED\r\n"
+		})
+	case "touch":
+		return s.withJob(args, func(j *job) string {
+			if j.state != RESERVED || j.owner != c {
+				return "NOT_FOUND\r\n"
+			}
+			j.until = s.now().Add(j.ttr)
+			return "TOUCHED\r\n"
+		})
+	case "kick":
+		if len(args) != 1 {
+			return "BAD_FORMAT\r\n"
+		}
+		bound, err := strconv.Atoi(args[0])
+		if err != nil {
+			return "BAD_FORMAT\r\n"
+		}
+		return fmt.Sprintf("KICKED %d\r\n", s.kick(c.use, bound))
+	case "kick-job":
+		return s.withJob(args, func(j *job) string {
+			if j.state != BURIED && j.state != DELAYED {
+				return "NOT_FOUND\r\n"
+			}
+			j.state = READY
+			j.kicks++
+			s.notify()
+			return "KICKED\r\n"
+		})
+	case "peek":
+		return s.withJob(args, found)
+	case "peek-ready", "peek-delayed", "peek-buried":
+		state := strings.TrimPrefix(cmd, "peek-")
+		if j := s.first(map[string]bool{c.use: true}, state, false); j != nil {
+			return found(j)
+		}
+		return "NOT_FOUND\r\n"
+	case "stats-job":
+		return s.withJob(args, func(j *job) string {
+			return s.statsJob(j)
+		})
+	case "stats-tube":
+		if len(args) != 1 {
+			return "BAD_FORMAT\r\n"
+		}
+		t, ok := s.tubes[args[0]]
+		if !ok {
+			return "NOT_FOUND\r\n"
+		}
+		return s.statsTube(t)
+	case "stats":
+		return s.stats()
+	case "list-tubes":
+		names := make([]string, 0, len(s.tubes))
+		for name := range s.tubes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return yamlList(names)
+	case "list-tube-used":
+		return "USING " + c.use + "\r\n"
+	case "list-tubes-watched":
+		names := make([]string, 0, len(c.watched))
+		for name := range c.watched {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return yamlList(names)
+	case "pause-tube":
+		if len(args) != 2 {
+			return "BAD_FORMAT\r\n"
+		}
+		delay, err := seconds(args[1])
+		if err != nil {
+			return "BAD_FORMAT\r\n"
+		}
+		t, ok := s.tubes[args[0]]
+		if !ok {
+			return "NOT_FOUND\r\n"
+		}
+		t.pause, t.pausedTill = delay, s.now().Add(delay)
+		t.pauses++
+		return "PAUSED\r\n"
+	}
+	return "UNKNOWN_COMMAND\r\n"
+}
+
+func (s *Server) put(c *conn, args []string, body []byte) string {
+	pri, err1 := strconv.ParseUint(args[0], 10, 32)
+	delay, err2 := seconds(args[1])
+	ttr, err3 := seconds(args[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return "BAD_FORMAT\r\n"
+	}
+	if ttr < time.Second {
+		ttr = time.Second
+	}
+	s.nextID++
+	j := &job{
+		id:      s.nextID,
+		tube:    c.use,
+		pri:     uint32(pri),
+		delay:   delay,
+		ttr:     ttr,
+		body:    body,
+		created: s.now(),
+	}
+	s.jobs[j.id] = j
+	s.tubeOf(c.use).total++
+	s.schedule(j)
+	return fmt.Sprintf("INSERTED %d\r\n", j.id)
+}
+
+// reserve waits for a ready job of the watched tubes, the TTR of a job the
+// connection holds running out, or the timeout.
+func (s *Server) reserve(c *conn, cmd string, args []string) string {
+	var deadline time.Time
+	if cmd == "reserve-with-timeout" {
+		if len(args) != 1 {
+			return "BAD_FORMAT\r\n"
+		}
+		timeout, err := seconds(args[0])
+		if err != nil {
+			return "BAD_FORMAT\r\n"
+		}
+		s.mu.Lock()
+		deadline = s.now().Add(timeout)
+		s.mu.Unlock()
+	}
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return "DRAINING\r\n"
+		}
+		s.tick()
+		now := s.now()
+		if j := s.first(c.watched, READY, true); j != nil {
+			j.state, j.owner, j.until = RESERVED, c, now.Add(j.ttr)
+			j.reserves++
+			s.mu.Unlock()
+			return fmt.Sprintf("RESERVED %d %d\r\n%s\r\n", j.id, len(j.body), j.body)
+		}
+		if s.deadlineSoon(c, now) {
+			s.mu.Unlock()
+			return "DEADLINE_SOON\r\n"
+		}
+		if !deadline.IsZero() && !now.Before(deadline) {
+			s.mu.Unlock()
+			return "TIMED_OUT\r\n"
+		}
+		wait := s.nextEvent(now, deadline)
+		changed := s.changed
+		s.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (s *Server) deadlineSoon(c *conn, now time.Time) bool {
+	for _, j := range s.jobs {
+		if j.state == RESERVED && j.owner == c && j.until.Sub(now) <= time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+// nextEvent returns how long until something may change on its own.
+func (s *Server) nextEvent(now, deadline time.Time) time.Duration {
+	next := deadline
+	consider := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	for _, j := range s.jobs {
+		if j.state == DELAYED || j.state == RESERVED {
+			consider(j.until)
+		}
+	}
+	for _, t := range s.tubes {
+		if t.pausedTill.After(now) {
+			consider(t.pausedTill)
+		}
+	}
+	if next.IsZero() {
+		return time.Hour
+	}
+	if d := next.Sub(now); d > 10*time.Millisecond {
+		return d
+	}
+	return 10 * time.Millisecond
+}
+
+// tick moves delayed jobs that are due to ready and takes back reserved
+// jobs whose TTR ran out.
+func (s *Server) tick() {
+	now := s.now()
+	for _, j := range s.jobs {
+		switch {
+		case j.state == DELAYED && !now.Before(j.until):
+			j.state = READY
+		case j.state == RESERVED && !now.Before(j.until):
+			j.state, j.owner = READY, nil
+			j.timeouts++
+		}
+	}
+}
+
+func (s *Server) schedule(j *job) {
+	if j.delay > 0 {
+		j.state, j.until = DELAYED, s.now().Add(j.delay)
+	} else {
+		j.state = READY
+	}
+	s.notify()
+}
+
+// first returns the job of tubes in state that comes first: by priority
+// then age for ready and buried jobs, by due time for delayed ones.
+func (s *Server) first(tubes map[string]bool, state string, skipPaused bool) *job {
+	now := s.now()
+	var best *job
+	for _, j := range s.jobs {
+		if j.state != state || !tubes[j.tube] {
+			continue
+		}
+		if skipPaused && s.tubeOf(j.tube).pausedTill.After(now) {
+			continue
+		}
+		if best == nil || before(j, best) {
+			best = j
+		}
+	}
+	return best
+}
+
+func before(a, b *job) bool {
+	if a.state == DELAYED {
+		if !a.until.Equal(b.until) {
+			return a.until.Before(b.until)
+		}
+		return a.id < b.id
+	}
+	if a.pri != b.pri {
+		return a.pri < b.pri
+	}
+	return a.id < b.id
+}
+
+// kick kicks buried jobs of name if there are any, delayed ones otherwise.
+func (s *Server) kick(name string, bound int) int {
+	tubes := map[string]bool{name: true}
+	state := BURIED
+	if s.first(tubes, BURIED, false) == nil {
+		state = DELAYED
+	}
+	n := 0
+	for ; n < bound; n++ {
+		j := s.first(tubes, state, false)
+		if j == nil {
+			break
+		}
+		j.state = READY
+		j.kicks++
+	}
+	if n > 0 {
+		s.notify()
+	}
+	return n
+}
+
+func (s *Server) withJob(args []string, f func(j *job) string) string {
+	if len(args) != 1 {
+		return "BAD_FORMAT\r\n"
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return "BAD_FORMAT\r\n"
+	}
+	j, ok := s.jobs[id]
+	if !ok {
+		return "NOT_FOUND\r\n"
+	}
+	return f(j)
+}
+
+func found(j *job) string {
+	return fmt.Sprintf("FOUND %d %d\r\n%s\r\n", j.id, len(j.body), j.body)
+}
+
+func (s *Server) statsJob(j *job) string {
+	now := s.now()
+	left := time.Duration(0)
+	if j.state == DELAYED || j.state == RESERVED {
+		left = j.until.Sub(now)
+	}
+	return yamlDict([][2]interface{}{
+		{"id", j.id},
+		{"tube", j.tube},
+		{"state", j.state},
+		{"pri", j.pri},
+		{"age", int64(now.Sub(j.created) / time.Second)},
+		{"delay", int64(j.delay / time.Second)},
+		{"ttr", int64(j.ttr / time.Second)},
+		{"time-left", int64(left / time.Second)},
+		{"file", 0},
+		{"reserves", j.reserves},
+		{"timeouts", j.timeouts},
+		{"releases", j.releases},
+		{"buries", j.buries},
+		{"kicks", j.kicks},
+	})
+}
+
+func (s *Server) count(name, state string, urgent bool) int {
+	n := 0
+	for _, j := range s.jobs {
+		if (name == "" || j.tube == name) && j.state == state && (!urgent || j.pri < 1024) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) statsTube(t *tube) string {
+	using, watching := 0, 0
+	for c := range s.conns {
+		if c.use == t.name {
+			using++
+		}
+		if c.watched[t.name] {
+			watching++
+		}
+	}
+	left := t.pausedTill.Sub(s.now())
+	if left < 0 {
+		left = 0
+	}
+	return yamlDict([][2]interface{}{
+		{"name", t.name},
+		{"current-jobs-urgent", s.count(t.name, READY, true)},
+		{"current-jobs-ready", s.count(t.name, READY, false)},
+		{"current-jobs-reserved", s.count(t.name, RESERVED, false)},
+		{"current-jobs-delayed", s.count(t.name, DELAYED, false)},
+		{"current-jobs-buried", s.count(t.name, BURIED, false)},
+		{"total-jobs", t.total},
+		{"current-using", using},
+		{"current-watching", watching},
+		{"current-waiting", 0},
+		{"cmd-delete", t.deletes},
+		{"cmd-pause-tube", t.pauses},
+		{"pause", int64(t.pause / time.Second)},
+		{"pause-time-left", int64(left / time.Second)},
+	})
+}
+
+func (s *Server) stats() string {
+	total := 0
+	for _, t := range s.tubes {
+		total += t.total
+	}
+	return yamlDict([][2]interface{}{
+		{"current-jobs-urgent", s.count("", READY, true)},
+		{"current-jobs-ready", s.count("", READY, false)},
+		{"current-jobs-reserved", s.count("", RESERVED, false)},
+		{"current-jobs-delayed", s.count("", DELAYED, false)},
+		{"current-jobs-buried", s.count("", BURIED, false)},
+		{"total-jobs", total},
+		{"current-tubes", len(s.tubes)},
+		{"current-connections", len(s.conns)},
+	})
+}
+
+func (s *Server) tubeOf(name string) *tube {
+	t, ok := s.tubes[name]
+	if !ok {
+		t = &tube{name: name}
+		s.tubes[name] = t
+	}
+	return t
+}
+
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+// notify wakes every reserve waiting for a change.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func seconds(arg string) (time.Duration, error) {
+	n, err := strconv.ParseUint(arg, 10, 32)
+	return time.Duration(n) * time.Second, err
+}
+
+func yamlDict(pairs [][2]interface{}) string {
+	var b strings.Builder
+	b.WriteString("---\n")
+	for _, kv := range pairs {
+		fmt.Fprintf(&b, "%s: %v\n", kv[0], kv[1])
+	}
+	return fmt.Sprintf("OK %d\r\n%s\r\n", b.Len(), b.String())
+}
+
+func yamlList(items []string) string {
+	var b strings.Builder
+	b.WriteString("---\n")
+	for _, item := range items {
+		fmt.Fprintf(&b, "- %s\n", item)
+	}
+	return fmt.Sprintf("OK %d\r\n%s\r\n", b.Len(), b.String())
+}
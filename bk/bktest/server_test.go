@@ -0,0 +1,144 @@
+package bktest_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lysu/go-misc/bk/bktest"
+	"github.com/stretchr/testify/assert"
+)
+
+type client struct {
+	t  *testing.T
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+func dial(t *testing.T, s *bktest.Server) *client {
+	nc, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	return &client{t: t, nc: nc, r: bufio.NewReader(nc)}
+}
+
+// do sends a command and returns the reply line, followed by the body for
+// replies that carry one.
+func (c *client) do(cmd string) string {
+	io.WriteString(c.nc, cmd+"\r\n")
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	words := strings.Fields(line)
+	switch words[0] {
+	case "RESERVED", "FOUND", "OK":
+		n, _ := strconv.Atoi(words[len(words)-1])
+		body := make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, body); err != nil {
+			c.t.Fatal(err)
+		}
+		return line + "\n" + string(body[:n])
+	}
+	return line
+}
+
+func server(t *testing.T) *bktest.Server {
+	s, err := bktest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestServer(t *testing.T) {
+	s := server(t)
+	producer, consumer := dial(t, s), dial(t, s)
+
+	assert.Equal(t, "USING jobs", producer.do("use jobs"))
+	assert.Equal(t, "INSERTED 1", producer.do("put 10 0 5 5\r\nhello"))
+	assert.Equal(t, "INSERTED 2", producer.do("put 1 0 5 3\r\nbye"))
+	assert.Equal(t, "INSERTED 3", producer.do("put 1 60 5 5\r\nlater"))
+
+	assert.Equal(t, "TIMED_OUT", consumer.do("reserve-with-timeout 0"))
+	assert.Equal(t, "WATCHING 2", consumer.do("watch jobs"))
+	assert.Equal(t, "WATCHING 1", consumer.do("ignore default"))
+	assert.Equal(t, "NOT_IGNORED", consumer.do("ignore jobs"))
+
+	// Priority first.
+	assert.Equal(t, "RESERVED 2 3\nbye", consumer.do("reserve-with-timeout 0"))
+	assert.Equal(t, "NOT_FOUND", producer.do("delete 2"))
+	assert.Equal(t, "DELETED", consumer.do("delete 2"))
+	assert.Equal(t, "RESERVED 1 5\nhello", consumer.do("reserve"))
+	assert.Equal(t, "BURIED", consumer.do("bury 1 7"))
+	assert.Equal(t, "FOUND 1 5\nhello", producer.do("peek-buried"))
+	assert.Equal(t, "FOUND 3 5\nlater", producer.do("peek-delayed"))
+	assert.Contains(t, producer.do("stats-tube jobs"), "current-jobs-buried: 1\n")
+
+	// Buried jobs are kicked before delayed ones.
+	assert.Equal(t, "KICKED 1", producer.do("kick 10"))
+	assert.Equal(t, "KICKED 1", producer.do("kick 10"))
+	assert.Equal(t, "NOT_FOUND", producer.do("kick-job 3"))
+	assert.Equal(t, "RESERVED 3 5\nlater", consumer.do("reserve"))
+	assert.Equal(t, "RESERVED 1 5\nhello", consumer.do("reserve"))
+	assert.Equal(t, "RELEASED", consumer.do("release 1 10 30"))
+	assert.Equal(t, "TOUCHED", consumer.do("touch 3"))
+	assert.Equal(t, "DELETED", consumer.do("delete 3"))
+
+	// A reserve waits for the delay to pass.
+	done := make(chan string)
+	other := dial(t, s)
+	other.do("watch jobs")
+	go func() { done <- other.do("reserve-with-timeout 60") }()
+	time.Sleep(20 * time.Millisecond)
+	s.Advance(30 * time.Second)
+	assert.Equal(t, "RESERVED 1 5\nhello", <-done)
+	stats := other.do("stats-job 1")
+	assert.Contains(t, stats, "state: reserved\n")
+	assert.Contains(t, stats, "releases: 1\n")
+	assert.Contains(t, stats, "age: 30\n")
+
+	// The TTR running out hands the job to someone else.
+	s.Advance(5 * time.Second)
+	assert.Equal(t, bktest.READY, s.State(1))
+	assert.Equal(t, "NOT_FOUND", other.do("release 1 0 0"))
+	assert.Contains(t, producer.do("stats-job 1"), "timeouts: 1\n")
+	assert.Equal(t, "RESERVED 1 5\nhello", consumer.do("reserve"))
+	s.Advance(4500 * time.Millisecond)
+	assert.Equal(t, "DEADLINE_SOON", consumer.do("reserve-with-timeout 0"))
+}
+
+func TestServerHook(t *testing.T) {
+	s := server(t)
+	c := dial(t, s)
+	s.SetHook(func(cmd string, args []string) bktest.Action {
+		switch cmd {
+		case "delete":
+			return bktest.Action{Reply: "INTERNAL_ERROR"}
+		case "kick-job":
+			return bktest.Action{Drop: true}
+		case "touch":
+			return bktest.Action{Delay: 50 * time.Millisecond}
+		}
+		return bktest.Action{}
+	})
+	assert.Equal(t, "INSERTED 1", c.do("put 0 10 5 1\r\nx"))
+	assert.Equal(t, "INTERNAL_ERROR", c.do("delete 1"))
+	assert.Equal(t, bktest.DELAYED, s.State(1))
+	start := time.Now()
+	assert.Equal(t, "NOT_FOUND", c.do("touch 1"))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	io.WriteString(c.nc, "kick-job 1\r\n")
+	_, err := c.r.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, bktest.DELAYED, s.State(1))
+}
@@ -0,0 +1,85 @@
+package bk
+
+import (
+	"log/slog"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type TxStatus int
+
+const (
+	// TX_UNKNOWN leaves the message held to be asked about again later.
+	TX_UNKNOWN TxStatus = iota
+	TX_COMMITTED
+	TX_ROLLED_BACK
+)
+
+// StatusLookup tells what became of the transaction that sent msg, for
+// example by looking up the business row with msg.Key.
+type StatusLookup func(c context.Context, msg *Message) (TxStatus, error)
+
+// Checker settles messages held by a backend whose sender died before
+// confirming or cancelling them.
+type Checker struct {
+	Backend Backend
+	Lookup  StatusLookup
+	// Age is how old a held message must be to be checked; younger ones
+	// may belong to transactions still running.
+	Age      time.Duration
+	Interval time.Duration
+	// Batch caps the messages checked per sweep, and per tube on
+	// Beanstalk.
+	Batch int
+	// Logger gets the errors Run keeps going after.
+	Logger *slog.Logger
+}
+
+// CheckResult counts the held messages a check confirmed, cancelled, and
+// put back to be asked about later.
+type CheckResult struct {
+	Kicked   int
+	Deleted  int
+	Requeued int
+}
+
+func NewChecker(backend Backend, lookup StatusLookup) *Checker {
+	return &Checker{
+		Backend:  backend,
+		Lookup:   lookup,
+		Age:      time.Minute,
+		Interval: 30 * time.Second,
+		Batch:    100,
+		Logger:   slog.Default(),
+	}
+}
+
+// Run sweeps every Interval until c is done. Errors are logged and the
+// next sweep tries again.
+func (ck *Checker) Run(c context.Context) error {
+	for {
+		if _, err := ck.Sweep(c); err != nil {
+			if c.Err() != nil {
+				return c.Err()
+			}
+			ck.logger().Warn("bk: check held messages", "err", err)
+		}
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-time.After(ck.Interval):
+		}
+	}
+}
+
+func (ck *Checker) Sweep(c context.Context) (*CheckResult, error) {
+	return ck.Backend.Check(c, ck.Lookup, ck.Age, ck.Batch)
+}
+
+func (ck *Checker) logger() *slog.Logger {
+	if ck.Logger == nil {
+		return slog.Default()
+	}
+	return ck.Logger
+}
@@ -0,0 +1,88 @@
+package bk_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lysu/go-misc/bk"
+	"github.com/lysu/go-misc/bk/bktest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestChecker(t *testing.T) {
+	s, err := bktest.NewServer()
+	assert.NoError(t, err)
+	defer s.Close()
+	backend := bk.NewBeanstalk(s.Addr)
+	backend.Tubes = []string{"orders"}
+	defer backend.Close()
+
+	// Held jobs left behind by senders that died.
+	ids := map[string]uint64{}
+	for _, key := range []string{"committed", "rolled-back", "unknown"} {
+		ids[key], err = backend.Prepare(&bk.Message{Key: key, Tube: "orders"})
+		assert.NoError(t, err)
+	}
+	lookups := 0
+	ck := bk.NewChecker(backend, func(c context.Context, msg *bk.Message) (bk.TxStatus, error) {
+		lookups++
+		switch msg.Key {
+		case "committed":
+			return bk.TX_COMMITTED, nil
+		case "rolled-back":
+			return bk.TX_ROLLED_BACK, nil
+		}
+		return bk.TX_UNKNOWN, nil
+	})
+
+	// Too young to be checked.
+	result, err := ck.Sweep(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, &bk.CheckResult{}, result)
+
+	s.Advance(2 * time.Minute)
+	result, err = ck.Sweep(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, &bk.CheckResult{Kicked: 1, Deleted: 1, Requeued: 1}, result)
+	assert.Equal(t, 3, lookups)
+	assert.Equal(t, bktest.READY, s.State(ids["committed"]))
+	assert.Equal(t, "", s.State(ids["rolled-back"]))
+	assert.Equal(t, "", s.State(ids["unknown"]))
+	assert.Equal(t, bktest.DELAYED, s.State(ids["unknown"]+1))
+}
+
+func TestCheckerRunKeepsGoing(t *testing.T) {
+	s, err := bktest.NewServer()
+	assert.NoError(t, err)
+	defer s.Close()
+	backend := bk.NewBeanstalk(s.Addr)
+	backend.Tubes = []string{"orders"}
+	defer backend.Close()
+	_, err = backend.Prepare(&bk.Message{Key: "a", Tube: "orders"})
+	assert.NoError(t, err)
+	s.Advance(2 * time.Minute)
+
+	lookups := make(chan struct{}, 10)
+	ck := bk.NewChecker(backend, func(c context.Context, msg *bk.Message) (bk.TxStatus, error) {
+		select {
+		case lookups <- struct{}{}:
+		default:
+		}
+		return bk.TX_UNKNOWN, errors.New("db down")
+	})
+	ck.Interval, ck.Logger = time.Millisecond, nil
+	c, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- ck.Run(c) }()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-lookups:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run stopped sweeping")
+		}
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lysu/go-misc/bk"
+	"github.com/lysu/go-misc/ds"
+)
+
+const (
+	exitCodeOk int = iota
+	exitBuried
+	exitFatalError
+)
+
+func MainCmd(args []string) int {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:11300", "beanstalkd address")
+	driver := flags.String("driver", "mysql", "driver of the dead letter store")
+	dsn := flags.String("dsn", "", "dead letter store, where workers record why jobs were buried")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] counts [tube...] | list <tube> | inspect <id> | edit <id> <file|-> | kick <id>... | kick-tube <tube> | delete <id>...\n", args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil || flags.NArg() == 0 {
+		flags.Usage()
+		return exitFatalError
+	}
+	backend := bk.NewBeanstalk(*addr)
+	defer backend.Close()
+	d := bk.NewDeadLetters(backend, nil)
+	if *dsn != "" {
+		db, err := sqlx.Open(*driver, *dsn)
+		if err != nil {
+			return fatal(err)
+		}
+		defer db.Close()
+		ds.RegisterDataSource(ds.DEFAULT_DATASOURCE, db)
+		d.Store = bk.NewDBDeadLetters(ds.DEFAULT_DATASOURCE)
+	}
+
+	cmd, rest := flags.Arg(0), flags.Args()[1:]
+	switch cmd {
+	case "counts":
+		counts, err := d.Counts(rest...)
+		if err != nil {
+			return fatal(err)
+		}
+		tubes := make([]string, 0, len(counts))
+		for tube := range counts {
+			tubes = append(tubes, tube)
+		}
+		sort.Strings(tubes)
+		buried := false
+		for _, tube := range tubes {
+			fmt.Printf("%s\t%d\n", tube, counts[tube])
+			buried = buried || counts[tube] > 0
+		}
+		if buried {
+			return exitBuried
+		}
+	case "list":
+		if len(rest) != 1 {
+			flags.Usage()
+			return exitFatalError
+		}
+		jobs, err := d.List(rest[0])
+		if err != nil {
+			return fatal(err)
+		}
+		for _, job := range jobs {
+			printJob(job, false)
+		}
+	case "inspect":
+		ids, err := parseIDs(rest)
+		if err != nil || len(ids) != 1 {
+			flags.Usage()
+			return exitFatalError
+		}
+		job, err := d.Inspect(ids[0])
+		if err != nil {
+			return fatal(err)
+		}
+		if job == nil {
+			return fatal(fmt.Errorf("job %d is not buried", ids[0]))
+		}
+		printJob(job, true)
+	case "edit":
+		if len(rest) != 2 {
+			flags.Usage()
+			return exitFatalError
+		}
+		ids, err := parseIDs(rest[:1])
+		if err != nil {
+			return fatal(err)
+		}
+		body, err := readBody(rest[1])
+		if err != nil {
+			return fatal(err)
+		}
+		id, err := d.Edit(ids[0], body)
+		if err != nil {
+			return fatal(err)
+		}
+		fmt.Printf("%d\n", id)
+	case "kick", "delete":
+		ids, err := parseIDs(rest)
+		if err != nil {
+			return fatal(err)
+		}
+		do := d.Kick
+		if cmd == "delete" {
+			do = d.Delete
+		}
+		n, err := do(ids...)
+		fmt.Printf("%d\n", n)
+		if err != nil {
+			return fatal(err)
+		}
+		if n < len(ids) {
+			fmt.Fprintf(os.Stderr, "%d of the jobs were not buried and were left alone\n", len(ids)-n)
+		}
+	case "kick-tube":
+		if len(rest) != 1 {
+			flags.Usage()
+			return exitFatalError
+		}
+		n, err := d.KickTube(rest[0])
+		fmt.Printf("%d\n", n)
+		if err != nil {
+			return fatal(err)
+		}
+	default:
+		flags.Usage()
+		return exitFatalError
+	}
+	return exitCodeOk
+}
+
+func printJob(job *bk.BuriedJob, body bool) {
+	key := ""
+	if job.Message != nil {
+		key = job.Message.Key
+	}
+	fmt.Printf("%d\t%s\tkey=%s\tage=%s\tburies=%s", job.ID, job.Tube, key, job.Stats["age"], job.Stats["buries"])
+	if job.Failure != nil {
+		fmt.Printf("\tattempts=%d\tburied=%s\t%s", job.Failure.Attempts,
+			job.Failure.BuriedAt.Format("2006-01-02 15:04:05"), job.Failure.Err)
+	}
+	fmt.Println()
+	if body {
+		fmt.Printf("%s\n", job.Body)
+	}
+}
+
+func parseIDs(args []string) ([]uint64, error) {
+	ids := make([]uint64, len(args))
+	for i, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad job id %q", arg)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+func readBody(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+func fatal(err error) int {
+	fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	return exitFatalError
+}
+
+func main() {
+	os.Exit(MainCmd(os.Args))
+}
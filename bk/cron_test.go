@@ -0,0 +1,42 @@
+package bk_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lysu/go-misc/bk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCron(t *testing.T) {
+	// A Monday.
+	from := time.Date(2026, 1, 5, 10, 2, 30, 0, time.UTC)
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2026, 1, 5, 10, 3, 0, 0, time.UTC)},
+		{"*/5 * * * *", time.Date(2026, 1, 5, 10, 5, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2026, 1, 5, 13, 0, 0, 0, time.UTC)},
+		{"30 8 * * MON-FRI", time.Date(2026, 1, 6, 8, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 1, 11, 0, 0, 0, 0, time.UTC)},
+		{"15 10 1,15 feb *", time.Date(2026, 2, 1, 10, 15, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted.
+		{"0 12 20 * 3", time.Date(2026, 1, 7, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 1, 6, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tc := range cases {
+		cr, err := bk.ParseCron(tc.expr)
+		if assert.NoError(t, err, tc.expr) {
+			assert.Equal(t, tc.next, cr.Next(from), tc.expr)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "* * * JANUARY *"} {
+		_, err := bk.ParseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
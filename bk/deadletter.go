@@ -0,0 +1,326 @@
+package bk
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lysu/beanstalk"
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/repo"
+	"golang.org/x/net/context"
+)
+
+// DeadLetter is why a Worker buried a job.
+type DeadLetter struct {
+	ID       uint64    `db:"id" json:"id"`
+	Tube     string    `db:"tube" json:"tube"`
+	Key      string    `db:"msg_key" json:"key"`
+	Err      string    `db:"err" json:"err"`
+	Attempts int       `db:"attempts" json:"attempts"`
+	BuriedAt time.Time `db:"buried_at" json:"buried_at"`
+}
+
+type DeadLetterStore interface {
+	Record(dl *DeadLetter) error
+	// Get returns nil for jobs without a record.
+	Get(id uint64) (*DeadLetter, error)
+	List(tube string) ([]*DeadLetter, error)
+	Forget(id uint64) error
+}
+
+var DeadLetterTable = "bk_dead_letter"
+
+// DeadLetterSchema returns the statement creating DeadLetterTable.
+func DeadLetterSchema() string {
+	return "CREATE TABLE " + DeadLetterTable + ` (
+	id BIGINT NOT NULL PRIMARY KEY,
+	tube VARCHAR(200) NOT NULL,
+	msg_key VARCHAR(255) NOT NULL,
+	err TEXT NOT NULL,
+	attempts INT NOT NULL,
+	buried_at DATETIME NOT NULL
+)`
+}
+
+type dbDeadLetters struct {
+	ds   string
+	repo *repo.Repository[DeadLetter]
+}
+
+// NewDBDeadLetters keeps dead letters in DeadLetterTable of ds.
+func NewDBDeadLetters(ds string) DeadLetterStore {
+	return &dbDeadLetters{ds: ds, repo: repo.New[DeadLetter](DeadLetterTable)}
+}
+
+func (s *dbDeadLetters) context() context.Context {
+	return ds.WithDataSource(context.Background(), s.ds)
+}
+
+// Record replaces any older record of the same ID, as beanstalkd reuses
+// IDs after a restart without binlog.
+func (s *dbDeadLetters) Record(dl *DeadLetter) error {
+	_, err := ds.InTx(s.context(), func(c context.Context) (interface{}, error) {
+		if err := s.repo.HardDelete(c, dl.ID); err != nil && err != repo.ErrNotFound {
+			return nil, err
+		}
+		return nil, s.repo.Insert(c, dl)
+	})
+	return err
+}
+
+func (s *dbDeadLetters) Get(id uint64) (*DeadLetter, error) {
+	dl, err := s.repo.Get(s.context(), id)
+	if err == repo.ErrNotFound {
+		return nil, nil
+	}
+	return dl, err
+}
+
+func (s *dbDeadLetters) List(tube string) ([]*DeadLetter, error) {
+	dls, err := s.repo.Find(s.context(), "tube = ?", tube)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*DeadLetter, len(dls))
+	for i := range dls {
+		list[i] = &dls[i]
+	}
+	return list, nil
+}
+
+func (s *dbDeadLetters) Forget(id uint64) error {
+	if err := s.repo.HardDelete(s.context(), id); err != nil && err != repo.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+type BuriedJob struct {
+	ID   uint64
+	Tube string
+	Body []byte
+	// Message is nil when Body is not one.
+	Message *Message
+	Stats   map[string]string
+	// Failure is nil for jobs buried without a record.
+	Failure *DeadLetter
+}
+
+// DeadLetters looks after buried jobs. Beanstalkd only shows the first
+// buried job of a tube, so the others are found through Store.
+type DeadLetters struct {
+	Backend *Beanstalk
+	Store   DeadLetterStore
+}
+
+func NewDeadLetters(backend *Beanstalk, store DeadLetterStore) *DeadLetters {
+	return &DeadLetters{Backend: backend, Store: store}
+}
+
+// List returns the buried jobs of tube, the recorded ones first.
+func (d *DeadLetters) List(tube string) ([]*BuriedJob, error) {
+	var jobs []*BuriedJob
+	seen := map[uint64]bool{}
+	if d.Store != nil {
+		dls, err := d.Store.List(tube)
+		if err != nil {
+			return nil, err
+		}
+		for _, dl := range dls {
+			job, err := d.Inspect(dl.ID)
+			if err != nil {
+				return nil, err
+			}
+			if job == nil || job.Tube != tube {
+				// Kicked or deleted by someone else.
+				if err = d.Store.Forget(dl.ID); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			jobs = append(jobs, job)
+			seen[job.ID] = true
+		}
+	}
+	var id uint64
+	err := d.Backend.do(func(conn *beanstalk.Conn) (err error) {
+		tube := &beanstalk.Tube{Conn: conn, Name: tube}
+		id, _, err = tube.PeekBuried()
+		return
+	})
+	if isNotFound(err) || seen[id] {
+		return jobs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job, err := d.Inspect(id)
+	if err != nil || job == nil {
+		return jobs, err
+	}
+	return append(jobs, job), nil
+}
+
+// Inspect returns the buried job id, or nil if id is not buried.
+func (d *DeadLetters) Inspect(id uint64) (*BuriedJob, error) {
+	job := &BuriedJob{ID: id}
+	err := d.Backend.do(func(conn *beanstalk.Conn) (err error) {
+		if job.Stats, err = conn.StatsJob(id); err != nil {
+			return
+		}
+		job.Body, err = conn.Peek(id)
+		return
+	})
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if job.Stats["state"] != "buried" {
+		return nil, nil
+	}
+	job.Tube = job.Stats["tube"]
+	if msg, err := Decode(id, job.Body); err == nil {
+		job.Message = msg
+	}
+	if d.Store != nil {
+		if job.Failure, err = d.Store.Get(id); err != nil {
+			return nil, err
+		}
+	}
+	return job, nil
+}
+
+// Edit replaces the body of a buried job, which puts it back as a new
+// ready job, and returns the new ID.
+func (d *DeadLetters) Edit(id uint64, body []byte) (uint64, error) {
+	job, err := d.Inspect(id)
+	if err != nil {
+		return 0, err
+	}
+	if job == nil {
+		return 0, errors.Errorf("job %d is not buried", id)
+	}
+	var newID uint64
+	err = d.Backend.do(func(conn *beanstalk.Conn) (err error) {
+		tube := &beanstalk.Tube{Conn: conn, Name: job.Tube}
+		ttr := time.Duration(statInt(job.Stats, "ttr")) * time.Second
+		if newID, err = tube.Put(body, uint32(statInt(job.Stats, "pri")), 0, ttr); err != nil {
+			return
+		}
+		return conn.Delete(id)
+	})
+	if err != nil {
+		return newID, err
+	}
+	return newID, d.forget(id)
+}
+
+// Kick makes the given buried jobs ready again and returns how many were.
+// Jobs that are not buried are left alone. Kicked jobs keep their release
+// and timeout counts, which Worker.MaxAttempts goes by; Edit puts a job
+// back as a new one instead.
+func (d *DeadLetters) Kick(ids ...uint64) (int, error) {
+	return d.each(ids, func(conn *beanstalk.Conn, id uint64) error {
+		return conn.KickJob(id)
+	})
+}
+
+// KickTube kicks every buried job of tube that List finds.
+func (d *DeadLetters) KickTube(tube string) (int, error) {
+	jobs, err := d.List(tube)
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]uint64, len(jobs))
+	for i, job := range jobs {
+		ids[i] = job.ID
+	}
+	return d.Kick(ids...)
+}
+
+// Delete deletes the given buried jobs and returns how many were. Jobs
+// that are not buried are left alone.
+func (d *DeadLetters) Delete(ids ...uint64) (int, error) {
+	return d.each(ids, func(conn *beanstalk.Conn, id uint64) error {
+		return conn.Delete(id)
+	})
+}
+
+func (d *DeadLetters) each(ids []uint64, f func(conn *beanstalk.Conn, id uint64) error) (int, error) {
+	n := 0
+	for _, id := range ids {
+		buried := false
+		err := d.Backend.do(func(conn *beanstalk.Conn) error {
+			stats, err := conn.StatsJob(id)
+			if err != nil {
+				return err
+			}
+			// kick-job would also kick a delayed job, such as a held
+			// message whose transaction may have rolled back.
+			if buried = stats["state"] == "buried"; !buried {
+				return nil
+			}
+			return f(conn, id)
+		})
+		if err != nil && !isNotFound(err) {
+			return n, errors.Annotatef(err, "job %d", id)
+		}
+		if err == nil && !buried {
+			continue
+		}
+		if err == nil {
+			n++
+		}
+		if err = d.forget(id); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (d *DeadLetters) forget(id uint64) error {
+	if d.Store == nil {
+		return nil
+	}
+	return d.Store.Forget(id)
+}
+
+// Counts returns the number of buried jobs of tubes, or of every tube when
+// none is given.
+func (d *DeadLetters) Counts(tubes ...string) (map[string]int, error) {
+	counts := map[string]int{}
+	err := d.Backend.do(func(conn *beanstalk.Conn) (err error) {
+		if len(tubes) == 0 {
+			if tubes, err = conn.ListTubes(); err != nil {
+				return
+			}
+		}
+		for _, name := range tubes {
+			tube := &beanstalk.Tube{Conn: conn, Name: name}
+			stats, err := tube.Stats()
+			if isNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			counts[name] = int(statInt(stats, "current-jobs-buried"))
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// Var exports Counts for expvar.Publish, e.g. as "bk_buried".
+func (d *DeadLetters) Var(tubes ...string) expvar.Var {
+	return expvar.Func(func() interface{} {
+		counts, err := d.Counts(tubes...)
+		if err != nil {
+			return map[string]string{"error": err.Error()}
+		}
+		return counts
+	})
+}
@@ -0,0 +1,92 @@
+package bk_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lysu/beanstalk"
+	"github.com/lysu/go-misc/bk"
+	"github.com/lysu/go-misc/bk/bktest"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestDeadLetters(t *testing.T) {
+	db := dstest.SQLite(t)
+	db.MustExec(bk.DeadLetterSchema())
+	store := bk.NewDBDeadLetters("default")
+	s, err := bktest.NewServer()
+	assert.NoError(t, err)
+	defer s.Close()
+	conn, err := beanstalk.Dial("tcp", s.Addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	var ids []uint64
+	for _, key := range []string{"a", "b", "c"} {
+		ids = append(ids, put(t, conn, key, time.Minute))
+	}
+	w := bk.NewWorker(s.Addr, func(c context.Context, msg *bk.Message) error {
+		return bk.Poison(errors.New("bad " + msg.Key))
+	}, "jobs")
+	w.DeadLetters = store
+	c, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- w.Run(c) }()
+	for deadline := time.Now().Add(5 * time.Second); s.State(ids[2]) != bktest.BURIED; {
+		if time.Now().After(deadline) {
+			t.Fatal("jobs not buried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-stopped
+
+	backend := bk.NewBeanstalk(s.Addr)
+	defer backend.Close()
+	d := bk.NewDeadLetters(backend, store)
+	counts, err := d.Counts("jobs")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"jobs": 3}, counts)
+
+	jobs, err := d.List("jobs")
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 3)
+	job, err := d.Inspect(ids[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "b", job.Message.Key)
+	assert.Equal(t, "poison: bad b", job.Failure.Err)
+	assert.Equal(t, 1, job.Failure.Attempts)
+
+	body, _ := (&bk.Message{Key: "b2"}).Encode()
+	newID, err := d.Edit(ids[1], body)
+	assert.NoError(t, err)
+	assert.Equal(t, "", s.State(ids[1]))
+	assert.Equal(t, bktest.READY, s.State(newID))
+
+	n, err := d.KickTube("jobs")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, bktest.READY, s.State(ids[0]))
+	jobs, err = d.List("jobs")
+	assert.NoError(t, err)
+	assert.Empty(t, jobs)
+	dl, err := store.Get(ids[0])
+	assert.NoError(t, err)
+	assert.Nil(t, dl)
+
+	// Jobs that are not buried are left alone.
+	held, err := (&beanstalk.Tube{Conn: conn, Name: "jobs"}).Put([]byte("held"), 0, time.Hour, time.Minute)
+	assert.NoError(t, err)
+	n, err = d.Kick(ids[0], held)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, bktest.DELAYED, s.State(held))
+	n, err = d.Delete(ids[0], held)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, bktest.READY, s.State(ids[0]))
+	assert.Equal(t, bktest.DELAYED, s.State(held))
+}
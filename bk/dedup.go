@@ -0,0 +1,159 @@
+package bk
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"golang.org/x/net/context"
+)
+
+// DedupStore remembers which messages were processed.
+type DedupStore interface {
+	// Do runs f unless msgID was done already, in which case it reports
+	// dup. msgID counts as done only if f succeeds.
+	Do(c context.Context, msgID string, f func(c context.Context) error) (dup bool, err error)
+}
+
+// Idempotent makes h skip messages that store has seen processed, as
+// retries and requeues deliver some messages more than once. Messages
+// without MsgID are always handled.
+func Idempotent(store DedupStore, h Handler) Handler {
+	return func(c context.Context, msg *Message) error {
+		if msg.MsgID == "" {
+			return h(c, msg)
+		}
+		_, err := store.Do(c, msg.MsgID, func(c context.Context) error {
+			return h(c, msg)
+		})
+		return err
+	}
+}
+
+// MemoryDedup keeps the last Size message IDs in memory. It only dedups
+// within one process and forgets on restart; use DBDedup when the
+// handler writes to a database.
+type MemoryDedup struct {
+	Size int
+
+	mu      sync.Mutex
+	lru     *list.List
+	done    map[string]*list.Element
+	running map[string]chan struct{}
+}
+
+func NewMemoryDedup(size int) *MemoryDedup {
+	return &MemoryDedup{
+		Size:    size,
+		lru:     list.New(),
+		done:    map[string]*list.Element{},
+		running: map[string]chan struct{}{},
+	}
+}
+
+// Do holds back a second delivery of msgID until the first one ends.
+func (m *MemoryDedup) Do(c context.Context, msgID string, f func(c context.Context) error) (bool, error) {
+	m.mu.Lock()
+	for {
+		if el, ok := m.done[msgID]; ok {
+			m.lru.MoveToFront(el)
+			m.mu.Unlock()
+			return true, nil
+		}
+		running, ok := m.running[msgID]
+		if !ok {
+			break
+		}
+		m.mu.Unlock()
+		select {
+		case <-running:
+		case <-c.Done():
+			return false, c.Err()
+		}
+		m.mu.Lock()
+	}
+	running := make(chan struct{})
+	m.running[msgID] = running
+	m.mu.Unlock()
+
+	err := f(c)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.running, msgID)
+	close(running)
+	if err != nil {
+		return false, err
+	}
+	m.done[msgID] = m.lru.PushFront(msgID)
+	for m.Size > 0 && m.lru.Len() > m.Size {
+		el := m.lru.Back()
+		m.lru.Remove(el)
+		delete(m.done, el.Value.(string))
+	}
+	return false, nil
+}
+
+func (m *MemoryDedup) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+var DedupTable = "bk_processed"
+
+// DedupSchema returns the statement creating DedupTable.
+func DedupSchema() string {
+	return "CREATE TABLE " + DedupTable + ` (
+	msg_id VARCHAR(64) NOT NULL PRIMARY KEY,
+	processed_at DATETIME NOT NULL
+)`
+}
+
+// DBDedup records processed message IDs in DedupTable of ds, in the same
+// transaction as the handler, so the handler's writes and the record
+// commit or roll back together. Handlers must therefore write through ds
+// with the context they are given.
+type DBDedup struct {
+	ds string
+}
+
+func NewDBDedup(ds string) *DBDedup {
+	return &DBDedup{ds: ds}
+}
+
+// Do runs f in ds.DoTx. Of two concurrent deliveries one fails on the
+// primary key and is retried, to find the message done by then.
+func (s *DBDedup) Do(c context.Context, msgID string, f func(c context.Context) error) (dup bool, err error) {
+	c = ds.WithDataSource(c, s.ds)
+	_, err = ds.DoTx(c, func(c context.Context) (interface{}, error) {
+		n, err := ds.Get[int](c, ds.Rebind(c, "SELECT COUNT(*) FROM "+DedupTable+" WHERE msg_id = ?"), msgID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if n > 0 {
+			dup = true
+			return nil, nil
+		}
+		_, err = ds.Exec(c, ds.Rebind(c, "INSERT INTO "+DedupTable+" (msg_id, processed_at) VALUES (?, ?)"), msgID, time.Now())
+		if err != nil {
+			return nil, errors.Annotatef(err, "record message %s", msgID)
+		}
+		return nil, f(c)
+	})
+	return dup && err == nil, err
+}
+
+// Purge forgets the messages processed before t, which must be longer ago
+// than any message can still be redelivered.
+func (s *DBDedup) Purge(t time.Time) (int64, error) {
+	c := ds.WithDataSource(context.Background(), s.ds)
+	result, err := ds.Exec(c, ds.Rebind(c, "DELETE FROM "+DedupTable+" WHERE processed_at < ?"), t)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	n, err := result.RowsAffected()
+	return n, errors.Trace(err)
+}
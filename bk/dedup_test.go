@@ -0,0 +1,100 @@
+package bk_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lysu/go-misc/bk"
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestMemoryDedup(t *testing.T) {
+	store := bk.NewMemoryDedup(2)
+	var calls int32
+	boom := errors.New("boom")
+	fail := true
+	h := bk.Idempotent(store, func(c context.Context, msg *bk.Message) error {
+		atomic.AddInt32(&calls, 1)
+		if msg.MsgID == "a" && fail {
+			return boom
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	c := context.Background()
+
+	assert.Equal(t, boom, h(c, &bk.Message{MsgID: "a"}))
+	fail = false
+	assert.NoError(t, h(c, &bk.Message{MsgID: "a"}))
+	assert.NoError(t, h(c, &bk.Message{MsgID: "a"}))
+	assert.Equal(t, int32(2), calls)
+
+	// Concurrent deliveries run once.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, h(c, &bk.Message{MsgID: "b"}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(3), calls)
+
+	// "a" is the least recently used.
+	assert.NoError(t, h(c, &bk.Message{MsgID: "c"}))
+	assert.Equal(t, 2, store.Len())
+	assert.NoError(t, h(c, &bk.Message{MsgID: "a"}))
+	assert.Equal(t, int32(5), calls)
+
+	assert.NoError(t, h(c, &bk.Message{}))
+	assert.NoError(t, h(c, &bk.Message{}))
+	assert.Equal(t, int32(7), calls)
+}
+
+func TestDBDedup(t *testing.T) {
+	db := dstest.SQLite(t)
+	db.MustExec(bk.DedupSchema())
+	db.MustExec("CREATE TABLE orders (id INTEGER PRIMARY KEY, paid INT)")
+	db.MustExec("INSERT INTO orders VALUES (1, 0)")
+	store := bk.NewDBDedup(ds.DEFAULT_DATASOURCE)
+	boom := errors.New("boom")
+	var fail error
+	h := bk.Idempotent(store, func(c context.Context, msg *bk.Message) error {
+		if _, err := ds.Exec(c, "UPDATE orders SET paid = paid + 1 WHERE id = 1"); err != nil {
+			return err
+		}
+		return fail
+	})
+	c := context.Background()
+	paid := func() int {
+		var n int
+		db.Get(&n, "SELECT paid FROM orders WHERE id = 1")
+		return n
+	}
+
+	// The failed attempt rolls back the payment and the record alike.
+	fail = boom
+	assert.Equal(t, boom, h(c, &bk.Message{MsgID: "m1"}))
+	assert.Equal(t, 0, paid())
+	fail = nil
+	assert.NoError(t, h(c, &bk.Message{MsgID: "m1"}))
+	assert.NoError(t, h(c, &bk.Message{MsgID: "m1"}))
+	assert.Equal(t, 1, paid())
+
+	dup, err := store.Do(c, "m1", func(c context.Context) error { return nil })
+	assert.NoError(t, err)
+	assert.True(t, dup)
+
+	n, err := store.Purge(time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, h(c, &bk.Message{MsgID: "m1"}))
+	assert.Equal(t, 2, paid())
+}
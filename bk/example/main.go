@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/lysu/go-misc/bk"
+	"github.com/lysu/go-misc/ds"
+	"golang.org/x/net/context"
+)
+
+func main() {
+	db, err := sqlx.Open("", "")
+	if err != nil {
+		panic(err)
+	}
+	ds.RegisterDataSource(ds.DEFAULT_DATASOURCE, db)
+
+	backend := bk.NewBeanstalk("127.0.0.1:11300")
+	defer backend.Close()
+	bk.Default = bk.NewSender(backend, nil)
+
+	// The job is put delayed first, then kicked once dbop commits or
+	// deleted once it rolls back.
+	err = bk.SendInTx(context.Background(), &bk.Message{Key: "order-1", Body: []byte("msg")}, dbop)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func dbop(c context.Context) error {
+	_, err := ds.Exec(c, "UPDATE orders SET state = 'paid' WHERE id = ?", 1)
+	return err
+}
@@ -0,0 +1,243 @@
+package bk
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"golang.org/x/net/context"
+)
+
+type JournalEntry struct {
+	ID      uint64    `json:"id"`
+	Op      Op        `json:"op"`
+	Attempt int       `json:"attempt"`
+	Time    time.Time `json:"time"`
+	Done    bool      `json:"done,omitempty"`
+	// Error is why the last attempt failed.
+	Error string `json:"error,omitempty"`
+}
+
+// FileJournal is an append-only JSON lines file synced on every write.
+// The last line of a job wins; Compact drops the settled ones.
+type FileJournal struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func NewFileJournal(path string) *FileJournal {
+	return &FileJournal{Path: path}
+}
+
+func (j *FileJournal) Record(id uint64, op Op) error {
+	return j.write(&JournalEntry{ID: id, Op: op, Time: time.Now()})
+}
+
+// Failed records another attempt at entry that failed with cause.
+func (j *FileJournal) Failed(entry *JournalEntry, cause error) error {
+	return j.write(&JournalEntry{ID: entry.ID, Op: entry.Op, Attempt: entry.Attempt + 1, Time: time.Now(), Error: cause.Error()})
+}
+
+func (j *FileJournal) Done(id uint64) error {
+	return j.write(&JournalEntry{ID: id, Time: time.Now(), Done: true})
+}
+
+func (j *FileJournal) write(entry *JournalEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f, err := os.OpenFile(j.Path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	// Start a new line after one torn by a crash.
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			b = append([]byte{'\n'}, b...)
+		}
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Sync())
+}
+
+func (j *FileJournal) Pending() ([]*JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.pending()
+}
+
+func (j *FileJournal) pending() ([]*JournalEntry, error) {
+	f, err := os.Open(j.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	var (
+		order   []uint64
+		entries = map[uint64]*JournalEntry{}
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := &JournalEntry{}
+		if json.Unmarshal(scanner.Bytes(), entry) != nil {
+			// Torn by a crash.
+			continue
+		}
+		if entry.Done {
+			delete(entries, entry.ID)
+			continue
+		}
+		if _, ok := entries[entry.ID]; !ok {
+			order = append(order, entry.ID)
+		}
+		entries[entry.ID] = entry
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var pending []*JournalEntry
+	for _, id := range order {
+		if entry, ok := entries[id]; ok {
+			pending = append(pending, entry)
+		}
+	}
+	return pending, nil
+}
+
+// Compact rewrites the journal with only its pending entries. The new file
+// replaces the old one by rename, so a crash leaves either of them whole.
+func (j *FileJournal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	pending, err := j.pending()
+	if err != nil {
+		return err
+	}
+	tmp := j.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	w := bufio.NewWriter(f)
+	for _, entry := range pending {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			f.Close()
+			return errors.Trace(err)
+		}
+		w.Write(append(b, '\n'))
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Trace(err)
+	}
+	if err = os.Rename(tmp, j.Path); err != nil {
+		return errors.Trace(err)
+	}
+	dir, err := os.Open(filepath.Dir(j.Path))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer dir.Close()
+	return errors.Trace(dir.Sync())
+}
+
+// Retrier replays the confirms and cancels of a FileJournal against the
+// backend they failed on.
+type Retrier struct {
+	Journal  *FileJournal
+	Backend  Backend
+	Interval time.Duration
+	Backoff  func(attempts int) time.Duration
+	Logger   *slog.Logger
+}
+
+func NewRetrier(journal *FileJournal, backend Backend) *Retrier {
+	return &Retrier{
+		Journal:  journal,
+		Backend:  backend,
+		Interval: 10 * time.Second,
+		Backoff:  ds.ExponentialBackoff(time.Second, 5*time.Minute),
+		Logger:   slog.Default(),
+	}
+}
+
+// Run retries right away, to settle what was left from before a restart,
+// and then every Interval until c is done. Journal errors are logged and
+// retried on the next round.
+func (r *Retrier) Run(c context.Context) error {
+	for {
+		if _, err := r.RetryOnce(); err != nil {
+			r.logger().Error("bk: retry journal", "path", r.Journal.Path, "err", err)
+		}
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-time.After(r.Interval):
+		}
+	}
+}
+
+// RetryOnce retries the pending entries whose backoff is over and returns
+// how many got settled. Only journal errors are returned; failed attempts
+// are recorded and retried later.
+func (r *Retrier) RetryOnce() (int, error) {
+	pending, err := r.Journal.Pending()
+	if err != nil {
+		return 0, err
+	}
+	settled := 0
+	for _, entry := range pending {
+		if entry.Attempt > 0 && time.Since(entry.Time) < r.Backoff(entry.Attempt) {
+			continue
+		}
+		do := r.Backend.Cancel
+		if entry.Op == OP_CONFIRM {
+			do = r.Backend.Confirm
+		}
+		if cause := do(entry.ID); cause != nil {
+			r.logger().Warn("bk: retry message", "id", entry.ID, "op", entry.Op, "attempt", entry.Attempt+1, "err", cause)
+			if err = r.Journal.Failed(entry, cause); err != nil {
+				return settled, err
+			}
+			continue
+		}
+		if err = r.Journal.Done(entry.ID); err != nil {
+			return settled, err
+		}
+		settled++
+	}
+	if settled > 0 {
+		return settled, r.Journal.Compact()
+	}
+	return settled, nil
+}
+
+func (r *Retrier) logger() *slog.Logger {
+	if r.Logger == nil {
+		return slog.Default()
+	}
+	return r.Logger
+}
@@ -0,0 +1,89 @@
+package bk_test
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lysu/go-misc/bk"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type flakyBackend struct {
+	*fakeBackend
+	down map[uint64]bool
+}
+
+func (b *flakyBackend) Confirm(id uint64) error {
+	if b.down[id] {
+		return errors.New("unreachable")
+	}
+	return b.fakeBackend.Confirm(id)
+}
+
+func TestRetrier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bk.journal")
+	j := bk.NewFileJournal(path)
+	assert.NoError(t, j.Record(1, bk.OP_CONFIRM))
+	assert.NoError(t, j.Record(2, bk.OP_CANCEL))
+	assert.NoError(t, j.Record(3, bk.OP_CONFIRM))
+
+	// A torn write at the end is ignored.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.WriteString(`{"id":4,"op":"conf`)
+	f.Close()
+
+	backend := &flakyBackend{fakeBackend: newFakeBackend(), down: map[uint64]bool{3: true}}
+	r := bk.NewRetrier(j, backend)
+	r.Backoff = func(attempts int) time.Duration { return time.Hour }
+	n, err := r.RetryOnce()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []uint64{1}, backend.confirmed)
+	assert.Equal(t, []uint64{2}, backend.cancelled)
+
+	pending, err := j.Pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, uint64(3), pending[0].ID)
+	assert.Equal(t, 1, pending[0].Attempt)
+	assert.Equal(t, "unreachable", pending[0].Error)
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(b), "\n"))
+
+	// Still backing off.
+	delete(backend.down, 3)
+	n, err = r.RetryOnce()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	r.Backoff = func(attempts int) time.Duration { return 0 }
+	n, err = r.RetryOnce()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	pending, err = j.Pending()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestRetrierRunKeepsGoing(t *testing.T) {
+	dir := t.TempDir()
+	// A directory cannot be opened as the journal.
+	j := bk.NewFileJournal(dir)
+	r := bk.NewRetrier(j, newFakeBackend())
+	var logs bytes.Buffer
+	r.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	r.Interval = time.Millisecond
+	c, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, r.Run(c))
+	assert.True(t, strings.Count(logs.String(), "bk: retry journal") > 1)
+}
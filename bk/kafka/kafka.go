@@ -0,0 +1,147 @@
+// Package kafka is a bk.Backend over Kafka, which cannot hold messages
+// back like beanstalkd does. Prepared messages wait in the ds outbox
+// instead and a ds.Relay produces them once confirmed.
+package kafka
+
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/bk"
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/repo"
+	"golang.org/x/net/context"
+)
+
+// held is a prepared message in ds.OutboxTable. NextAttemptAt is when it
+// was last checked.
+type held struct {
+	ID            int64     `db:"id"`
+	Topic         string    `db:"topic"`
+	Key           string    `db:"msg_key"`
+	Payload       []byte    `db:"payload"`
+	Status        int       `db:"status"`
+	NextAttemptAt time.Time `db:"next_attempt_at"`
+	CreatedAt     time.Time `db:"created_at"`
+}
+
+// Backend keeps prepared messages in the outbox of DS as ds.OUTBOX_HELD,
+// hands them to the Relay on Confirm and drops them on Cancel. Run the
+// Relay of the backend to produce them with Producer.
+type Backend struct {
+	Producer sarama.SyncProducer
+	DS       string
+	// Topic is used for messages without Tube.
+	Topic string
+	Now   func() time.Time
+
+	repo *repo.Repository[held]
+}
+
+func New(producer sarama.SyncProducer, dataSource string) *Backend {
+	b := &Backend{Producer: producer, DS: dataSource, Now: time.Now}
+	b.repo = repo.New[held](ds.OutboxTable)
+	b.repo.Now = func() time.Time { return b.Now() }
+	return b
+}
+
+// Relay produces the confirmed messages of DS with Producer, along with
+// anything else written there with ds.Outbox. Run one per data source.
+func (b *Backend) Relay() *ds.Relay {
+	r := ds.NewRelay(b.DS, ds.PublisherFunc(b.produce))
+	r.Now = func() time.Time { return b.Now() }
+	return r
+}
+
+func (b *Backend) produce(c context.Context, msg *ds.OutboxMessage) error {
+	pm := &sarama.ProducerMessage{Topic: msg.Topic, Value: sarama.ByteEncoder(msg.Payload)}
+	if msg.Key != "" {
+		// Messages of a key keep their order on one partition.
+		pm.Key = sarama.StringEncoder(msg.Key)
+	}
+	_, _, err := b.Producer.SendMessage(pm)
+	return errors.Annotatef(err, "produce message %d", msg.ID)
+}
+
+func (b *Backend) context() context.Context {
+	return ds.WithDataSource(context.Background(), b.DS)
+}
+
+// Prepare stores msg outside of any transaction, so it stays when the
+// sender's transaction rolls back and Cancel can find it.
+func (b *Backend) Prepare(msg *bk.Message) (uint64, error) {
+	topic := msg.Tube
+	if topic == "" {
+		topic = b.Topic
+	}
+	if topic == "" {
+		return 0, errors.New("no topic for message")
+	}
+	body, err := msg.Encode()
+	if err != nil {
+		return 0, err
+	}
+	h := &held{Topic: topic, Key: msg.Key, Payload: body, Status: ds.OUTBOX_HELD, NextAttemptAt: b.Now()}
+	if err = b.repo.Insert(b.context(), h); err != nil {
+		return 0, err
+	}
+	return uint64(h.ID), nil
+}
+
+// Confirm treats a message that is not held as confirmed already.
+func (b *Backend) Confirm(id uint64) error {
+	c := b.context()
+	_, err := ds.Exec(c, ds.Rebind(c, "UPDATE "+ds.OutboxTable+" SET status = ?, next_attempt_at = ? WHERE id = ? AND status = ?"),
+		ds.OUTBOX_PENDING, b.Now(), int64(id), ds.OUTBOX_HELD)
+	return errors.Trace(err)
+}
+
+// Cancel leaves messages that are no longer held to the Relay.
+func (b *Backend) Cancel(id uint64) error {
+	c := b.context()
+	_, err := ds.Exec(c, ds.Rebind(c, "DELETE FROM "+ds.OutboxTable+" WHERE id = ? AND status = ?"), int64(id), ds.OUTBOX_HELD)
+	return errors.Trace(err)
+}
+
+// Check goes through the messages checked longest ago. The ones of
+// unknown status count as checked now, which puts them behind the others.
+func (b *Backend) Check(c context.Context, lookup bk.StatusLookup, age time.Duration, n int) (*bk.CheckResult, error) {
+	result := &bk.CheckResult{}
+	dc := b.context()
+	hs, err := ds.Select[held](dc, ds.Rebind(dc, "SELECT id, topic, msg_key, payload, status, next_attempt_at, created_at FROM "+ds.OutboxTable+
+		" WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT ?"), ds.OUTBOX_HELD, b.Now().Add(-age), n)
+	if err != nil {
+		return result, errors.Trace(err)
+	}
+	for _, h := range hs {
+		id := uint64(h.ID)
+		status := bk.TX_UNKNOWN
+		if msg, err := bk.Decode(id, h.Payload); err == nil {
+			msg.Tube = h.Topic
+			if status, err = lookup(c, msg); err != nil {
+				return result, errors.Annotatef(err, "look up message %d", id)
+			}
+		}
+		switch status {
+		case bk.TX_COMMITTED:
+			if err = b.Confirm(id); err == nil {
+				result.Kicked++
+			}
+		case bk.TX_ROLLED_BACK:
+			if err = b.Cancel(id); err == nil {
+				result.Deleted++
+			}
+		default:
+			_, err = ds.Exec(dc, ds.Rebind(dc, "UPDATE "+ds.OutboxTable+" SET next_attempt_at = ? WHERE id = ? AND status = ?"),
+				b.Now(), h.ID, ds.OUTBOX_HELD)
+			if err == nil {
+				result.Requeued++
+			}
+		}
+		if err != nil {
+			return result, errors.Trace(err)
+		}
+	}
+	return result, nil
+}
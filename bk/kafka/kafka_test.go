@@ -0,0 +1,77 @@
+package kafka_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/lysu/go-misc/bk"
+	"github.com/lysu/go-misc/bk/bktest"
+	"github.com/lysu/go-misc/bk/kafka"
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"golang.org/x/net/context"
+)
+
+type producer struct {
+	mu   sync.Mutex
+	sent []*sarama.ProducerMessage
+}
+
+func (p *producer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = append(p.sent, msg)
+	return 0, int64(len(p.sent) - 1), nil
+}
+
+func (p *producer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		p.SendMessage(msg)
+	}
+	return nil
+}
+
+func (p *producer) Close() error { return nil }
+
+func (p *producer) take() []*sarama.ProducerMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sent := p.sent
+	p.sent = nil
+	return sent
+}
+
+func TestBackend(t *testing.T) {
+	bktest.RunBackendTests(t, func(t *testing.T) *bktest.Harness {
+		dstest.CreateOutbox(t, dstest.SQLite(t))
+		p := &producer{}
+		backend := kafka.New(p, ds.DEFAULT_DATASOURCE)
+		// Ahead of the real time the outbox is stamped with.
+		now := time.Now().Add(time.Second)
+		backend.Now = func() time.Time { return now }
+		relay := backend.Relay()
+		return &bktest.Harness{
+			Backend: backend,
+			Tube:    "orders",
+			Delivered: func() []*bk.Message {
+				if _, err := relay.RelayOnce(context.Background()); err != nil {
+					t.Error(err)
+				}
+				var msgs []*bk.Message
+				for _, m := range p.take() {
+					if m.Topic != "orders" {
+						t.Errorf("produced to %s", m.Topic)
+					}
+					body, _ := m.Value.Encode()
+					if msg, err := bk.Decode(uint64(m.Offset), body); err == nil {
+						msgs = append(msgs, msg)
+					}
+				}
+				return msgs
+			},
+			Advance: func(d time.Duration) { now = now.Add(d) },
+		}
+	})
+}
@@ -0,0 +1,248 @@
+package bk
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/repo"
+	"golang.org/x/net/context"
+)
+
+// ScheduledJob is a message to put at NextRun, and again at every time
+// Cron matches after that when set.
+type ScheduledJob struct {
+	ID   int64  `db:"id"`
+	Name string `db:"name"`
+	// Cron is empty for one-off jobs.
+	Cron     string    `db:"cron"`
+	Tube     string    `db:"tube"`
+	Key      string    `db:"msg_key"`
+	Body     []byte    `db:"body"`
+	Priority uint32    `db:"priority"`
+	TTR      int       `db:"ttr"`
+	NextRun  time.Time `db:"next_run"`
+}
+
+var ScheduleTable = "bk_schedule"
+
+// ScheduleSchema returns the MySQL statement creating ScheduleTable.
+func ScheduleSchema() string {
+	return "CREATE TABLE " + ScheduleTable + ` (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	cron VARCHAR(255) NOT NULL DEFAULT '',
+	tube VARCHAR(200) NOT NULL,
+	msg_key VARCHAR(255) NOT NULL DEFAULT '',
+	body BLOB NOT NULL,
+	priority INT UNSIGNED NOT NULL DEFAULT 0,
+	ttr INT NOT NULL DEFAULT 0,
+	next_run DATETIME NOT NULL,
+	UNIQUE KEY uk_name (name),
+	KEY idx_next_run (next_run)
+)`
+}
+
+// Scheduler keeps its schedule in ScheduleTable of DS and puts each job
+// as a delayed beanstalk job once it is due within Lookahead. Replicas
+// sharing DS take turns: each instance goes to whichever one moves the
+// job's NextRun on first. Instances are sent with MsgID name@unixtime, so
+// an Idempotent consumer also drops the rare one put twice by a replica
+// that died in between.
+type Scheduler struct {
+	Backend *Beanstalk
+	DS      string
+	// Lookahead is how early instances are put; the schedule can still be
+	// changed for the later ones.
+	Lookahead time.Duration
+	Interval  time.Duration
+	// Batch caps the instances put per tick.
+	Batch int
+	// Location is where cron expressions are read.
+	Location *time.Location
+	Now      func() time.Time
+	// Logger gets the errors Run keeps going after.
+	Logger *slog.Logger
+
+	repo *repo.Repository[ScheduledJob]
+}
+
+func NewScheduler(backend *Beanstalk, ds string) *Scheduler {
+	return &Scheduler{
+		Backend:   backend,
+		DS:        ds,
+		Lookahead: time.Minute,
+		Interval:  10 * time.Second,
+		Batch:     100,
+		Location:  time.Local,
+		Now:       time.Now,
+		Logger:    slog.Default(),
+		repo:      repo.New[ScheduledJob](ScheduleTable),
+	}
+}
+
+func (s *Scheduler) context() context.Context {
+	return ds.WithDataSource(context.Background(), s.DS)
+}
+
+// At puts msg at t once. It replaces any job of the same name.
+func (s *Scheduler) At(name string, t time.Time, msg *Message) error {
+	return s.save(name, "", t, msg)
+}
+
+// Cron puts msg every time expr matches from now on. It replaces any job
+// of the same name.
+func (s *Scheduler) Cron(name, expr string, msg *Message) error {
+	cr, err := ParseCron(expr)
+	if err != nil {
+		return err
+	}
+	next := cr.Next(s.Now().In(s.Location))
+	if next.IsZero() {
+		return errors.Errorf("cron %q never matches", expr)
+	}
+	return s.save(name, expr, next, msg)
+}
+
+func (s *Scheduler) save(name, expr string, t time.Time, msg *Message) error {
+	job := &ScheduledJob{
+		Name:     name,
+		Cron:     expr,
+		Tube:     tubeName(msg.Tube),
+		Key:      msg.Key,
+		Body:     msg.Body,
+		Priority: msg.Priority,
+		TTR:      int(msg.TTR / time.Second),
+		// DATETIME keeps seconds only, and Tick compares NextRun as read.
+		NextRun: t.Truncate(time.Second),
+	}
+	if job.Body == nil {
+		job.Body = []byte{}
+	}
+	_, err := ds.InTx(s.context(), func(c context.Context) (interface{}, error) {
+		if err := s.remove(c, name); err != nil {
+			return nil, err
+		}
+		return nil, s.repo.Insert(c, job)
+	})
+	return err
+}
+
+func (s *Scheduler) Remove(name string) error {
+	return s.remove(s.context(), name)
+}
+
+func (s *Scheduler) remove(c context.Context, name string) error {
+	_, err := ds.Exec(c, ds.Rebind(c, "DELETE FROM "+ScheduleTable+" WHERE name = ?"), name)
+	return errors.Trace(err)
+}
+
+func (s *Scheduler) List() ([]ScheduledJob, error) {
+	return s.repo.Find(s.context(), "")
+}
+
+// Run ticks right away, to catch up on what came due while no scheduler
+// ran, and then every Interval until c is done. Errors are logged and the
+// next tick tries again.
+func (s *Scheduler) Run(c context.Context) error {
+	for {
+		if _, err := s.Tick(c); err != nil {
+			if c.Err() != nil {
+				return c.Err()
+			}
+			s.logger().Warn("bk: schedule", "ds", s.DS, "err", err)
+		}
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-time.After(s.Interval):
+		}
+	}
+}
+
+func (s *Scheduler) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
+
+// Tick puts the instances due within Lookahead and returns how many this
+// replica put.
+func (s *Scheduler) Tick(c context.Context) (int, error) {
+	now := s.Now()
+	dc := s.context()
+	jobs, err := ds.Select[ScheduledJob](dc, ds.Rebind(dc, "SELECT id, name, cron, tube, msg_key, body, priority, ttr, next_run FROM "+ScheduleTable+
+		" WHERE next_run <= ? ORDER BY next_run, id LIMIT ?"), now.Add(s.Lookahead), s.Batch)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	n := 0
+	for i := range jobs {
+		if c.Err() != nil {
+			return n, c.Err()
+		}
+		put, err := s.materialize(dc, &jobs[i], now)
+		if err != nil {
+			return n, errors.Annotatef(err, "schedule %s", jobs[i].Name)
+		}
+		if put {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// materialize claims the instance at job.NextRun by moving NextRun on, or
+// deleting a one-off job, and puts it in the same transaction. Instances
+// missed while no scheduler ran collapse into this one.
+func (s *Scheduler) materialize(c context.Context, job *ScheduledJob, now time.Time) (bool, error) {
+	var next time.Time
+	if job.Cron != "" {
+		cr, err := ParseCron(job.Cron)
+		if err != nil {
+			return false, err
+		}
+		next = cr.Next(job.NextRun.In(s.Location))
+		if next.Before(now) {
+			next = cr.Next(now.In(s.Location))
+		}
+	}
+	return ds.InTx(c, func(c context.Context) (bool, error) {
+		query, args := "DELETE FROM "+ScheduleTable+" WHERE id = ? AND next_run = ?", []interface{}{job.ID, job.NextRun}
+		if !next.IsZero() {
+			query, args = "UPDATE "+ScheduleTable+" SET next_run = ? WHERE id = ? AND next_run = ?", append([]interface{}{next}, args...)
+		}
+		result, err := ds.Exec(c, ds.Rebind(c, query), args...)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			// Another replica got there first.
+			return false, errors.Trace(err)
+		}
+		delay := job.NextRun.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		id, err := s.Backend.put(&Message{
+			MsgID:    fmt.Sprintf("%s@%d", job.Name, job.NextRun.Unix()),
+			Key:      job.Key,
+			Body:     job.Body,
+			Tube:     job.Tube,
+			Priority: job.Priority,
+			TTR:      time.Duration(job.TTR) * time.Second,
+		}, delay)
+		if err != nil {
+			return false, err
+		}
+		return true, ds.AfterTx(c, func(committed bool) {
+			if !committed {
+				// Left to whichever replica claims it next.
+				s.Backend.Cancel(id)
+			}
+		})
+	})
+}
@@ -0,0 +1,135 @@
+package bk_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lysu/beanstalk"
+	"github.com/lysu/go-misc/bk"
+	"github.com/lysu/go-misc/bk/bktest"
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestScheduler(t *testing.T) {
+	db := dstest.SQLite(t)
+	db.MustExec(`CREATE TABLE bk_schedule (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		cron TEXT NOT NULL DEFAULT '',
+		tube TEXT NOT NULL,
+		msg_key TEXT NOT NULL DEFAULT '',
+		body BLOB NOT NULL,
+		priority INT NOT NULL DEFAULT 0,
+		ttr INT NOT NULL DEFAULT 0,
+		next_run DATETIME NOT NULL
+	)`)
+	s, err := bktest.NewServer()
+	assert.NoError(t, err)
+	defer s.Close()
+	backend := bk.NewBeanstalk(s.Addr)
+	defer backend.Close()
+	conn, err := beanstalk.Dial("tcp", s.Addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	jobs := beanstalk.NewTubeSet(conn, "jobs")
+
+	now := time.Date(2026, 1, 5, 10, 0, 30, 0, time.UTC)
+	replica := func() *bk.Scheduler {
+		sched := bk.NewScheduler(backend, ds.DEFAULT_DATASOURCE)
+		sched.Location = time.UTC
+		sched.Now = func() time.Time { return now }
+		return sched
+	}
+	a, b := replica(), replica()
+	c := context.Background()
+	assert.NoError(t, a.Cron("every-5", "*/5 * * * *", &bk.Message{Tube: "jobs", Key: "report"}))
+	assert.NoError(t, a.At("once", now.Add(30*time.Second), &bk.Message{Tube: "jobs", Key: "reminder", TTR: time.Minute}))
+	assert.Error(t, a.Cron("bad", "* * *", &bk.Message{}))
+
+	// Only one replica puts each instance.
+	n, err := a.Tick(c)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = b.Tick(c)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	now = now.Add(4 * time.Minute)
+	n, err = b.Tick(c)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = a.Tick(c)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Both went delayed by their time left.
+	id, _, err := (&beanstalk.Tube{Conn: conn, Name: "jobs"}).PeekDelayed()
+	assert.NoError(t, err)
+	stats, err := conn.StatsJob(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "30", stats["delay"])
+	s.Advance(time.Hour)
+	var msgs []*bk.Message
+	for {
+		id, body, err := jobs.Reserve(0)
+		if err != nil {
+			break
+		}
+		msg, err := bk.Decode(id, body)
+		assert.NoError(t, err)
+		msgs = append(msgs, msg)
+		conn.Delete(id)
+	}
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, "reminder", msgs[0].Key)
+		assert.Equal(t, "report", msgs[1].Key)
+		assert.Equal(t, "every-5@1767607500", msgs[1].MsgID)
+	}
+
+	// A scheduler starting after a while puts the missed instances once.
+	now = time.Date(2026, 1, 5, 10, 31, 0, 0, time.UTC)
+	n, err = replica().Tick(c)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	list, err := a.List()
+	assert.NoError(t, err)
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, "every-5", list[0].Name)
+		assert.True(t, time.Date(2026, 1, 5, 10, 35, 0, 0, time.UTC).Equal(list[0].NextRun))
+	}
+
+	assert.NoError(t, a.Remove("every-5"))
+	list, err = a.List()
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+}
+
+func TestSchedulerRunKeepsGoing(t *testing.T) {
+	// No schedule table, so every tick fails.
+	dstest.SQLite(t)
+	sched := bk.NewScheduler(nil, ds.DEFAULT_DATASOURCE)
+	ticks := make(chan struct{}, 1)
+	sched.Now = func() time.Time {
+		select {
+		case ticks <- struct{}{}:
+		default:
+		}
+		return time.Now()
+	}
+	sched.Interval, sched.Logger = time.Millisecond, nil
+	c, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- sched.Run(c) }()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ticks:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run stopped ticking")
+		}
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
@@ -0,0 +1,263 @@
+package bk
+
+import (
+	stderrors "errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lysu/beanstalk"
+	"github.com/lysu/go-misc/ds"
+	"golang.org/x/net/context"
+)
+
+// Handler processes one message. Returning nil deletes the job, a Poison
+// error buries it and any other error releases it to be retried.
+type Handler func(c context.Context, msg *Message) error
+
+type poisonError struct {
+	err error
+}
+
+func (e *poisonError) Error() string { return fmt.Sprintf("poison: %v", e.err) }
+func (e *poisonError) Unwrap() error { return e.err }
+
+// Poison marks err as one retrying cannot fix, so the job gets buried.
+func Poison(err error) error {
+	return &poisonError{err: err}
+}
+
+type retryError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryError) Error() string { return fmt.Sprintf("retry in %s: %v", e.delay, e.err) }
+func (e *retryError) Unwrap() error { return e.err }
+
+// RetryAfter releases the job with delay d instead of the backoff.
+func RetryAfter(err error, d time.Duration) error {
+	return &retryError{err: err, delay: d}
+}
+
+// Worker reserves jobs from Tubes and runs Handler on them, one job per
+// connection and Concurrency connections at most, one if unset.
+type Worker struct {
+	Addr        string
+	Tubes       []string
+	Handler     Handler
+	Concurrency int
+	// MaxAttempts buries jobs that failed this many times, counting TTR
+	// timeouts. Zero retries forever. Beanstalkd keeps counting across a
+	// kick, so a job kicked by DeadLetters.Kick is buried again after one
+	// more failure; DeadLetters.Edit puts it back with fresh counts.
+	MaxAttempts int
+	Backoff     func(attempts int) time.Duration
+	// ReserveTimeout bounds how long a stop waits for idle connections.
+	ReserveTimeout time.Duration
+	// DeadLetters, if set, records why jobs were buried.
+	DeadLetters DeadLetterStore
+	Logger      *slog.Logger
+}
+
+func NewWorker(addr string, handler Handler, tubes ...string) *Worker {
+	if len(tubes) == 0 {
+		tubes = []string{"default"}
+	}
+	return &Worker{
+		Addr:           addr,
+		Tubes:          tubes,
+		Handler:        handler,
+		Concurrency:    4,
+		MaxAttempts:    10,
+		Backoff:        ds.ExponentialBackoff(time.Second, 5*time.Minute),
+		ReserveTimeout: time.Second,
+		Logger:         slog.Default(),
+	}
+}
+
+// Run works until c is done, then lets the jobs in hand finish and
+// returns.
+func (w *Worker) Run(c context.Context) error {
+	n := w.Concurrency
+	if n <= 0 {
+		n = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.loop(c)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// RunUntilSignal is Run stopped by SIGINT or SIGTERM.
+func (w *Worker) RunUntilSignal() error {
+	c, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return w.Run(c)
+}
+
+func (w *Worker) loop(c context.Context) {
+	var conn *beanstalk.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for c.Err() == nil {
+		if conn == nil {
+			var err error
+			if conn, err = beanstalk.Dial("tcp", w.Addr); err != nil {
+				w.logger().Warn("bk: dial", "addr", w.Addr, "err", err)
+				w.pause(c)
+				continue
+			}
+		}
+		ts := beanstalk.NewTubeSet(conn, w.Tubes...)
+		id, body, err := ts.Reserve(w.ReserveTimeout)
+		if err != nil {
+			if cerr, ok := err.(beanstalk.ConnError); ok && (cerr.Err == beanstalk.ErrTimeout || cerr.Err == beanstalk.ErrDeadline) {
+				continue
+			}
+			w.logger().Warn("bk: reserve", "addr", w.Addr, "err", err)
+			if !isReply(err) {
+				conn.Close()
+				conn = nil
+			}
+			w.pause(c)
+			continue
+		}
+		if err = w.process(conn, id, body); err != nil && !isReply(err) {
+			w.logger().Warn("bk: settle job", "id", id, "err", err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+func (w *Worker) logger() *slog.Logger {
+	if w.Logger == nil {
+		return slog.Default()
+	}
+	return w.Logger
+}
+
+func (w *Worker) pause(c context.Context) {
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+	}
+}
+
+// process runs the handler on a reserved job, touching it while the
+// handler runs, and settles the job with the result.
+func (w *Worker) process(conn *beanstalk.Conn, id uint64, body []byte) error {
+	stats, err := conn.StatsJob(id)
+	if err != nil {
+		return err
+	}
+	pri := uint32(statInt(stats, "pri"))
+	msg, err := Decode(id, body)
+	if err != nil {
+		return w.bury(conn, &Message{ID: id, Tube: stats["tube"], Priority: pri}, 1, err)
+	}
+	msg.Tube, msg.Priority = stats["tube"], pri
+	msg.TTR = time.Duration(statInt(stats, "ttr")) * time.Second
+
+	// The handler context ends if the job is lost to its TTR anyway.
+	c, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var touching sync.WaitGroup
+	touching.Add(1)
+	go func() {
+		defer touching.Done()
+		w.touch(conn, id, msg.TTR, done, cancel)
+	}()
+	err = w.call(c, msg)
+	close(done)
+	touching.Wait()
+	cancel()
+
+	if err == nil {
+		return conn.Delete(id)
+	}
+	attempts := int(statInt(stats, "releases")+statInt(stats, "timeouts")) + 1
+	var (
+		poison *poisonError
+		retry  *retryError
+	)
+	if stderrors.As(err, &poison) || w.MaxAttempts > 0 && attempts >= w.MaxAttempts {
+		return w.bury(conn, msg, attempts, err)
+	}
+	delay := w.Backoff(attempts)
+	if stderrors.As(err, &retry) {
+		delay = retry.delay
+	}
+	return conn.Release(id, pri, delay)
+}
+
+func (w *Worker) bury(conn *beanstalk.Conn, msg *Message, attempts int, cause error) error {
+	w.logger().Warn("bk: bury job", "id", msg.ID, "key", msg.Key, "attempts", attempts, "err", cause)
+	if err := conn.Bury(msg.ID, msg.Priority); err != nil {
+		return err
+	}
+	if w.DeadLetters == nil {
+		return nil
+	}
+	err := w.DeadLetters.Record(&DeadLetter{
+		ID:       msg.ID,
+		Tube:     msg.Tube,
+		Key:      msg.Key,
+		Err:      cause.Error(),
+		Attempts: attempts,
+		BuriedAt: time.Now(),
+	})
+	if err != nil {
+		w.logger().Error("bk: record dead letter", "id", msg.ID, "err", err)
+	}
+	return nil
+}
+
+// call runs the handler, turning a panic into a poison error.
+func (w *Worker) call(c context.Context, msg *Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = Poison(errors.Errorf("panic: %v", r))
+		}
+	}()
+	return w.Handler(c, msg)
+}
+
+// touch renews the reservation halfway through each TTR.
+func (w *Worker) touch(conn *beanstalk.Conn, id uint64, ttr time.Duration, done <-chan struct{}, lost func()) {
+	interval := ttr / 2
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.Touch(id); err != nil {
+				w.logger().Warn("bk: touch job", "id", id, "err", err)
+				if isNotFound(err) {
+					lost()
+					return
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
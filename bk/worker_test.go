@@ -0,0 +1,139 @@
+package bk_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lysu/beanstalk"
+	"github.com/lysu/go-misc/bk"
+	"github.com/lysu/go-misc/bk/bktest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func put(t *testing.T, conn *beanstalk.Conn, key string, ttr time.Duration) uint64 {
+	body, err := (&bk.Message{Key: key}).Encode()
+	assert.NoError(t, err)
+	tube := &beanstalk.Tube{Conn: conn, Name: "jobs"}
+	id, err := tube.Put(body, 0, 0, ttr)
+	assert.NoError(t, err)
+	return id
+}
+
+func TestWorker(t *testing.T) {
+	s, err := bktest.NewServer()
+	assert.NoError(t, err)
+	defer s.Close()
+	conn, err := beanstalk.Dial("tcp", s.Addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	ids := map[string]uint64{}
+	for _, key := range []string{"ok", "retry", "poison", "panic"} {
+		ids[key] = put(t, conn, key, time.Minute)
+	}
+	ids["slow"] = put(t, conn, "slow", time.Second)
+
+	var (
+		mu   sync.Mutex
+		seen = map[string]int{}
+		done = make(chan struct{})
+	)
+	w := bk.NewWorker(s.Addr, func(c context.Context, msg *bk.Message) error {
+		mu.Lock()
+		seen[msg.Key]++
+		if len(seen) == 5 && seen[msg.Key] == 1 {
+			close(done)
+		}
+		mu.Unlock()
+		switch msg.Key {
+		case "retry":
+			return bk.RetryAfter(errors.New("busy"), time.Hour)
+		case "poison":
+			return bk.Poison(errors.New("bad"))
+		case "panic":
+			panic("boom")
+		case "slow":
+			// Outlives its TTR unless touched.
+			time.Sleep(1500 * time.Millisecond)
+		}
+		return nil
+	}, "jobs")
+	w.Concurrency = 2
+
+	c, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- w.Run(c) }()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("jobs not handled")
+	}
+	cancel()
+	assert.NoError(t, <-stopped)
+
+	assert.Equal(t, "", s.State(ids["ok"]))
+	assert.Equal(t, bktest.DELAYED, s.State(ids["retry"]))
+	assert.Equal(t, bktest.BURIED, s.State(ids["poison"]))
+	assert.Equal(t, bktest.BURIED, s.State(ids["panic"]))
+	assert.Equal(t, "", s.State(ids["slow"]))
+	assert.Equal(t, 1, seen["slow"])
+}
+
+// runWorker runs w until handled is closed.
+func runWorker(t *testing.T, w *bk.Worker, handled <-chan struct{}) {
+	c, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- w.Run(c) }()
+	select {
+	case <-handled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("jobs not handled")
+	}
+	cancel()
+	assert.NoError(t, <-stopped)
+}
+
+func TestWorkerAttempts(t *testing.T) {
+	s, err := bktest.NewServer()
+	assert.NoError(t, err)
+	defer s.Close()
+	conn, err := beanstalk.Dial("tcp", s.Addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// Zero MaxAttempts retries forever, and zero Concurrency runs one
+	// connection.
+	id := put(t, conn, "retry", time.Minute)
+	tries := 0
+	done := make(chan struct{})
+	w := bk.NewWorker(s.Addr, func(c context.Context, msg *bk.Message) error {
+		if tries++; tries < 15 {
+			return errors.New("busy")
+		}
+		close(done)
+		return nil
+	}, "jobs")
+	w.Concurrency, w.MaxAttempts, w.Logger = 0, 0, nil
+	w.Backoff = func(attempts int) time.Duration { return 0 }
+	runWorker(t, w, done)
+	assert.Equal(t, "", s.State(id))
+
+	// A TTR timeout counts as an attempt.
+	id = put(t, conn, "lost", time.Second)
+	ts := beanstalk.NewTubeSet(conn, "jobs")
+	_, _, err = ts.Reserve(time.Second)
+	assert.NoError(t, err)
+	s.Advance(2 * time.Second)
+	assert.Equal(t, bktest.READY, s.State(id))
+	done = make(chan struct{})
+	w.Handler = func(c context.Context, msg *bk.Message) error {
+		close(done)
+		return errors.New("busy")
+	}
+	w.MaxAttempts = 2
+	runWorker(t, w, done)
+	assert.Equal(t, bktest.BURIED, s.State(id))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lysu/go-misc/ds"
+)
+
+const (
+	exitCodeOk int = iota
+	exitPending
+	exitFatalError
+)
+
+func MainCmd(args []string) int {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	path := flags.String("log", "compensation.log", "compensation log written by ds.DoMultiTx")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-log file] list | resolve <id>...\n", args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil || flags.NArg() == 0 {
+		flags.Usage()
+		return exitFatalError
+	}
+	log := ds.NewFileCompensationLog(*path)
+	switch flags.Arg(0) {
+	case "list":
+		pending, err := log.Pending()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			return exitFatalError
+		}
+		for _, entry := range pending {
+			fmt.Printf("%s\t%s\tcommitted=%s\tfailed=%s\t%s\n", entry.ID, entry.Time.Format("2006-01-02 15:04:05"),
+				strings.Join(entry.Committed, ","), strings.Join(entry.Failed, ","), entry.Err)
+			for _, action := range entry.Actions {
+				fmt.Printf("\t%s\t%s\t%s\n", action.DataSource, action.Action, action.Payload)
+			}
+		}
+		if len(pending) > 0 {
+			return exitPending
+		}
+	case "resolve":
+		for _, id := range flags.Args()[1:] {
+			if err := log.Resolve(id); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				return exitFatalError
+			}
+		}
+	default:
+		flags.Usage()
+		return exitFatalError
+	}
+	return exitCodeOk
+}
+
+func main() {
+	os.Exit(MainCmd(os.Args))
+}
@@ -0,0 +1,163 @@
+package ds
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+type CompensationAction struct {
+	DataSource string          `json:"ds"`
+	Action     string          `json:"action"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+}
+
+type CompensationEntry struct {
+	ID        string               `json:"id"`
+	Time      time.Time            `json:"time"`
+	Committed []string             `json:"committed,omitempty"`
+	Failed    []string             `json:"failed,omitempty"`
+	Err       string               `json:"err,omitempty"`
+	Actions   []CompensationAction `json:"actions,omitempty"`
+	Resolved  bool                 `json:"resolved,omitempty"`
+}
+
+type CompensationLog interface {
+	Append(entry *CompensationEntry) error
+	Pending() ([]*CompensationEntry, error)
+	Resolve(id string) error
+}
+
+// FileCompensationLog is an append-only JSON lines file; resolving an
+// entry appends a marker line instead of rewriting the file.
+type FileCompensationLog struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func NewFileCompensationLog(path string) *FileCompensationLog {
+	return &FileCompensationLog{Path: path}
+}
+
+func (l *FileCompensationLog) Append(entry *CompensationEntry) error {
+	return l.write(entry)
+}
+
+func (l *FileCompensationLog) Resolve(id string) error {
+	return l.write(&CompensationEntry{ID: id, Time: time.Now(), Resolved: true})
+}
+
+func (l *FileCompensationLog) write(entry *CompensationEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	// Start a new line after one torn by a crash.
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			b = append([]byte{'\n'}, b...)
+		}
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Sync())
+}
+
+func (l *FileCompensationLog) Pending() ([]*CompensationEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.Open(l.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	var (
+		order   []string
+		entries = map[string]*CompensationEntry{}
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		entry := &CompensationEntry{}
+		if json.Unmarshal(scanner.Bytes(), entry) != nil {
+			// Torn by a crash.
+			continue
+		}
+		if entry.Resolved {
+			delete(entries, entry.ID)
+			continue
+		}
+		if _, ok := entries[entry.ID]; !ok {
+			order = append(order, entry.ID)
+		}
+		entries[entry.ID] = entry
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var pending []*CompensationEntry
+	for _, id := range order {
+		if entry, ok := entries[id]; ok {
+			pending = append(pending, entry)
+		}
+	}
+	return pending, nil
+}
+
+type CompensationHandler func(c context.Context, entry *CompensationEntry, action CompensationAction) error
+
+// ReplayCompensations runs the handler registered for every action of each
+// pending entry and resolves the entries whose actions all succeed. It
+// returns how many entries were resolved.
+func ReplayCompensations(c context.Context, log CompensationLog, handlers map[string]CompensationHandler) (int, error) {
+	pending, err := log.Pending()
+	if err != nil {
+		return 0, err
+	}
+	resolved := 0
+	var firstErr error
+	for _, entry := range pending {
+		err = replayEntry(c, entry, handlers)
+		if err == nil {
+			err = log.Resolve(entry.ID)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = errors.Annotatef(err, "entry %s", entry.ID)
+			}
+			continue
+		}
+		resolved++
+	}
+	return resolved, firstErr
+}
+
+func replayEntry(c context.Context, entry *CompensationEntry, handlers map[string]CompensationHandler) error {
+	for _, action := range entry.Actions {
+		handler, ok := handlers[action.Action]
+		if !ok {
+			return errors.Errorf("No handler for action %s", action.Action)
+		}
+		if err := handler(WithDataSource(c, action.DataSource), entry, action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
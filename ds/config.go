@@ -0,0 +1,210 @@
+package ds
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v2"
+)
+
+type ReplicaConfig struct {
+	Name   string `yaml:"name"`
+	DSN    string `yaml:"dsn"`
+	Weight int    `yaml:"weight"`
+}
+
+type DataSourceConfig struct {
+	Driver          string          `yaml:"driver"`
+	DSN             string          `yaml:"dsn"`
+	MaxOpenConns    int             `yaml:"max_open_conns"`
+	MaxIdleConns    int             `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration   `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration   `yaml:"conn_max_idle_time"`
+	Replicas        []ReplicaConfig `yaml:"replicas"`
+	MaxReplicaLag   time.Duration   `yaml:"max_replica_lag"`
+	ReplicaInterval time.Duration   `yaml:"replica_check_interval"`
+}
+
+type Config struct {
+	DataSources map[string]DataSourceConfig `yaml:"datasources"`
+}
+
+// LoadConfig reads path, if not empty, as YAML and then applies
+// DS_<NAME>_<FIELD> environment overrides, e.g. DS_DEFAULT_DSN.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{DataSources: map[string]DataSourceConfig{}}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = yaml.Unmarshal(b, cfg); err != nil {
+			return nil, errors.Annotatef(err, "parse %s", path)
+		}
+		if cfg.DataSources == nil {
+			cfg.DataSources = map[string]DataSourceConfig{}
+		}
+	}
+	if err := cfg.applyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+var envFields = []string{
+	"_DRIVER", "_DSN", "_MAX_OPEN_CONNS", "_MAX_IDLE_CONNS",
+	"_CONN_MAX_LIFETIME", "_CONN_MAX_IDLE_TIME", "_MAX_REPLICA_LAG",
+}
+
+func (cfg *Config) applyEnv(environ []string) error {
+	for _, kv := range environ {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 || !strings.HasPrefix(kv, "DS_") {
+			continue
+		}
+		key, value := kv[len("DS_"):i], kv[i+1:]
+		for _, field := range envFields {
+			if !strings.HasSuffix(key, field) || len(key) == len(field) {
+				continue
+			}
+			name := strings.ToLower(key[:len(key)-len(field)])
+			dsc := cfg.DataSources[name]
+			if err := dsc.set(field, value); err != nil {
+				return errors.Annotatef(err, "DS_%s", key)
+			}
+			cfg.DataSources[name] = dsc
+			break
+		}
+	}
+	return nil
+}
+
+func (dsc *DataSourceConfig) set(field, value string) (err error) {
+	switch field {
+	case "_DRIVER":
+		dsc.Driver = value
+	case "_DSN":
+		dsc.DSN = value
+	case "_MAX_OPEN_CONNS":
+		dsc.MaxOpenConns, err = strconv.Atoi(value)
+	case "_MAX_IDLE_CONNS":
+		dsc.MaxIdleConns, err = strconv.Atoi(value)
+	case "_CONN_MAX_LIFETIME":
+		dsc.ConnMaxLifetime, err = time.ParseDuration(value)
+	case "_CONN_MAX_IDLE_TIME":
+		dsc.ConnMaxIdleTime, err = time.ParseDuration(value)
+	case "_MAX_REPLICA_LAG":
+		dsc.MaxReplicaLag, err = time.ParseDuration(value)
+	}
+	return
+}
+
+// Open connects and pings every configured data source and its replicas
+// and registers them. Nothing is registered if any of them fails.
+func Open(cfg *Config) error {
+	var opened []*sqlx.DB
+	fail := func(err error) error {
+		for _, db := range opened {
+			db.Close()
+		}
+		return err
+	}
+	primaries := map[string]*sqlx.DB{}
+	replicas := map[string]*ReplicaSet{}
+	for name, dsc := range cfg.DataSources {
+		db, err := dsc.open(dsc.DSN)
+		if err != nil {
+			return fail(errors.Annotatef(err, "data source %s", name))
+		}
+		opened = append(opened, db)
+		primaries[name] = db
+		if len(dsc.Replicas) == 0 {
+			continue
+		}
+		var members []Replica
+		for i, rc := range dsc.Replicas {
+			rdb, err := dsc.open(rc.DSN)
+			if err != nil {
+				return fail(errors.Annotatef(err, "data source %s replica %d", name, i))
+			}
+			opened = append(opened, rdb)
+			members = append(members, Replica{Name: rc.Name, DB: rdb, Weight: rc.Weight})
+		}
+		replicas[name] = NewReplicaSet(lagFunc(dsc.Driver), dsc.MaxReplicaLag, members...)
+	}
+	for name, db := range primaries {
+		RegisterDataSource(name, db)
+	}
+	for name, rs := range replicas {
+		interval := cfg.DataSources[name].ReplicaInterval
+		if interval <= 0 {
+			interval = 5 * time.Second
+		}
+		rs.Start(interval)
+		RegisterReplicas(name, rs)
+	}
+	return nil
+}
+
+func (dsc DataSourceConfig) open(dsn string) (*sqlx.DB, error) {
+	if dsc.Driver == "" || dsn == "" {
+		return nil, errors.New("driver and dsn are required")
+	}
+	db, err := sqlx.Connect(dsc.Driver, dsn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if dsc.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(dsc.MaxOpenConns)
+	}
+	if dsc.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(dsc.MaxIdleConns)
+	}
+	if dsc.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(dsc.ConnMaxLifetime)
+	}
+	if dsc.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(dsc.ConnMaxIdleTime)
+	}
+	return db, nil
+}
+
+func lagFunc(driver string) LagFunc {
+	switch driver {
+	case "mysql":
+		return MySQLLag
+	case "postgres", "pgx":
+		return PostgresLag
+	}
+	return nil
+}
+
+// Close closes every registered data source, replica and statement cache
+// and unregisters them.
+func Close() error {
+	registry.Lock()
+	defer registry.Unlock()
+	var firstErr error
+	for name, sc := range StmtCaches {
+		sc.Close()
+		delete(StmtCaches, name)
+	}
+	for name, rs := range Replicas {
+		if err := rs.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(Replicas, name)
+	}
+	for name, db := range DataSources {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(DataSources, name)
+	}
+	return firstErr
+}
@@ -0,0 +1,45 @@
+package ds_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lysu/go-misc/ds"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ds.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+datasources:
+  default:
+    driver: mysql
+    dsn: "root@tcp(127.0.0.1:3306)/app"
+    max_open_conns: 20
+    conn_max_lifetime: 5m
+    replicas:
+      - name: r1
+        dsn: "root@tcp(127.0.0.2:3306)/app"
+        weight: 2
+`), 0644)
+	assert.NoError(t, err)
+	t.Setenv("DS_DEFAULT_MAX_OPEN_CONNS", "50")
+	t.Setenv("DS_ORDERS_DRIVER", "postgres")
+	t.Setenv("DS_ORDERS_DSN", "postgres://localhost/orders")
+
+	cfg, err := ds.LoadConfig(path)
+	assert.NoError(t, err)
+	def := cfg.DataSources["default"]
+	assert.Equal(t, "mysql", def.Driver)
+	assert.Equal(t, 50, def.MaxOpenConns)
+	assert.Equal(t, 5*time.Minute, def.ConnMaxLifetime)
+	assert.Equal(t, []ds.ReplicaConfig{{Name: "r1", DSN: "root@tcp(127.0.0.2:3306)/app", Weight: 2}}, def.Replicas)
+	assert.Equal(t, "postgres", cfg.DataSources["orders"].Driver)
+	assert.Equal(t, "postgres://localhost/orders", cfg.DataSources["orders"].DSN)
+
+	t.Setenv("DS_ORDERS_MAX_IDLE_CONNS", "many")
+	_, err = ds.LoadConfig(path)
+	assert.Error(t, err)
+}
@@ -1,6 +1,10 @@
 package ds
 
 import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
 	"github.com/jmoiron/sqlx"
 	"github.com/juju/errors"
 	"golang.org/x/net/context"
@@ -10,13 +14,23 @@ const DEFAULT_DATASOURCE = "default"
 
 var DataSources = map[string]*sqlx.DB{}
 
+// registry guards DataSources and Replicas against Close, for readers
+// like HealthChecker that may run while it does.
+var registry sync.RWMutex
+
 func RegisterDataSource(ds string, db *sqlx.DB) {
+	registry.Lock()
+	defer registry.Unlock()
 	DataSources[ds] = db
 }
 
 const (
 	DATASOURCE_KEY  = "_ds_"
 	DS_EXECUTOR_KEY = "_executor_"
+	DS_TX_KEY       = "_tx_"
+	READONLY_KEY    = "_readonly_"
+	// NO_STMT_CACHE_KEY is set by NoStmtCache.
+	NO_STMT_CACHE_KEY = "_no_stmt_cache_"
 )
 
 type IExecutor interface {
@@ -31,44 +45,217 @@ func Executor(c context.Context) (IExecutor, error) {
 	return nil, errors.New("Context without any sql executor")
 }
 
+func ReadOnly(c context.Context) context.Context {
+	return context.WithValue(c, READONLY_KEY, true)
+}
+
+func WithDataSource(c context.Context, ds string) context.Context {
+	return context.WithValue(c, DATASOURCE_KEY, ds)
+}
+
 func DoNoTx(c context.Context, f func(c context.Context) (interface{}, error)) (v interface{}, err error) {
-	dsKey := c.Value(DATASOURCE_KEY)
-	if dsKey == nil {
-		dsKey = DEFAULT_DATASOURCE
+	dsKey, err := dataSourceKey(c)
+	if err != nil {
+		return
+	}
+	if bt := currentTx(c); bt != nil && bt.nested && bt.ds == dsKey {
+		return f(bindExecutor(c, dsKey, bt.tx))
+	}
+	db, err := DataSource(dsKey)
+	if err != nil {
+		return
+	}
+	var exe IExecutor = db
+	if isReadOnly(c) && !inTx(c) {
+		if rs := replicaSet(dsKey); rs != nil {
+			if db := rs.Pick(); db != nil {
+				exe = db
+			}
+		}
 	}
-	c = context.WithValue(c, DS_EXECUTOR_KEY, DataSources[dsKey.(string)])
+	c = bindExecutor(c, dsKey, exe)
 	return f(c)
 }
 
+// DoTx runs f in a transaction of c's data source, or in a savepoint when c
+// is inside a BindTx transaction, and rolls back when f fails. An error
+// matched by noRollbackErrs commits and is dropped, as DoTx returns the
+// result of the commit; one marked CommitAnyway commits and is returned.
 func DoTx(c context.Context, f func(c context.Context) (interface{}, error), noRollbackErrs ...error) (v interface{}, err error) {
-	dsKey := c.Value(DATASOURCE_KEY)
-	if dsKey == nil {
-		dsKey = DEFAULT_DATASOURCE
+	dsKey, err := dataSourceKey(c)
+	if err != nil {
+		return
+	}
+	if bt := currentTx(c); bt != nil && bt.nested && bt.ds == dsKey {
+		return doSavepoint(c, bt, f, noRollbackErrs)
+	}
+	db, err := DataSource(dsKey)
+	if err != nil {
+		return
 	}
-	var tx *sqlx.Tx
-	tx, err = DataSources[dsKey.(string)].Beginx()
+	tx, err := db.Beginx()
 	if err != nil {
 		return
 	}
-	c = context.WithValue(c, DS_EXECUTOR_KEY, tx)
+	bt := &boundTx{ds: dsKey, tx: tx}
+	c = context.WithValue(c, DS_TX_KEY, bt)
+	c = bindExecutor(c, dsKey, tx)
 	v, err = f(c)
-	if err != nil && !isRollbackErr(err, noRollbackErrs) {
+	if err != nil && isRollbackErr(err, noRollbackErrs) {
 		err2 := tx.Rollback()
 		if err2 != nil {
 			err = err2
 		}
+		Instrument.endTx(dsKey, false, err2)
+		bt.runHooks(0, false)
 		return
 	}
-	err = tx.Commit()
+	err = keptErr(err)
+	err2 := tx.Commit()
+	if err2 != nil {
+		err = err2
+	}
+	Instrument.endTx(dsKey, true, err2)
+	bt.runHooks(0, err2 == nil)
 	return
 
 }
 
-func isRollbackErr(err error, noRollbackErrs []error) bool {
-	for _, noRollbackErr := range noRollbackErrs {
-		if err == noRollbackErr {
-			return false
+// AfterTx runs f once the transaction of c ends, telling whether it was
+// committed. A savepoint rolled back runs the hooks registered inside it
+// right away. Hooks of a BindTx transaction only run that way, as ds does
+// not see it end.
+func AfterTx(c context.Context, f func(committed bool)) error {
+	bt := currentTx(c)
+	if bt == nil {
+		return errors.New("AfterTx must be called inside DoTx")
+	}
+	bt.mu.Lock()
+	bt.hooks = append(bt.hooks, f)
+	bt.mu.Unlock()
+	return nil
+}
+
+// InBoundTx tells whether DoTx under c would only open a savepoint of a
+// BindTx transaction, whose end ds does not see.
+func InBoundTx(c context.Context) bool {
+	bt := currentTx(c)
+	if bt == nil || !bt.nested {
+		return false
+	}
+	dsKey, err := dataSourceKey(c)
+	return err == nil && bt.ds == dsKey
+}
+
+// BindTx makes tx the transaction of ds for everything run under the
+// returned context: DoNoTx reuses it and nested DoTx become savepoints.
+// The caller stays responsible for committing or rolling back tx.
+func BindTx(c context.Context, ds string, tx *sqlx.Tx) context.Context {
+	c = context.WithValue(c, DATASOURCE_KEY, ds)
+	c = context.WithValue(c, DS_TX_KEY, &boundTx{ds: ds, tx: tx, nested: true})
+	return bindExecutor(c, ds, tx)
+}
+
+type boundTx struct {
+	ds     string
+	tx     *sqlx.Tx
+	nested bool
+	seq    int64
+	mu     sync.Mutex
+	hooks  []func(committed bool)
+}
+
+// runHooks runs and drops the hooks registered from the from-th on.
+func (bt *boundTx) runHooks(from int, committed bool) {
+	bt.mu.Lock()
+	var hooks []func(committed bool)
+	if from < len(bt.hooks) {
+		hooks = bt.hooks[from:]
+		bt.hooks = bt.hooks[:from]
+	}
+	bt.mu.Unlock()
+	for _, f := range hooks {
+		f(committed)
+	}
+}
+
+func (bt *boundTx) hookCount() int {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return len(bt.hooks)
+}
+
+func doSavepoint(c context.Context, bt *boundTx, f func(c context.Context) (interface{}, error), noRollbackErrs []error) (v interface{}, err error) {
+	name := fmt.Sprintf("ds_sp_%d", atomic.AddInt64(&bt.seq, 1))
+	if _, err = bt.tx.Exec("SAVEPOINT " + name); err != nil {
+		return
+	}
+	hooks := bt.hookCount()
+	v, err = f(bindExecutor(c, bt.ds, bt.tx))
+	if err != nil && isRollbackErr(err, noRollbackErrs) {
+		if _, err2 := bt.tx.Exec("ROLLBACK TO SAVEPOINT " + name); err2 != nil {
+			err = err2
+		}
+		bt.runHooks(hooks, false)
+		return
+	}
+	err = keptErr(err)
+	if _, err2 := bt.tx.Exec("RELEASE SAVEPOINT " + name); err2 != nil {
+		err = err2
+	}
+	return
+}
+
+func bindExecutor(c context.Context, dsKey string, exe IExecutor) context.Context {
+	if sc := stmtCache(dsKey); sc != nil && !noStmtCache(c) {
+		switch e := exe.(type) {
+		case *sqlx.Tx:
+			exe = &cachedExecutor{IExecutor: e, cache: sc, tx: e}
+		case *sqlx.DB:
+			// Replicas have no cache of their own.
+			if e == sc.db {
+				exe = &cachedExecutor{IExecutor: e, cache: sc}
+			}
 		}
 	}
-	return true
+	if Instrument != nil {
+		exe = &instrumentedExecutor{IExecutor: exe, ds: dsKey, inst: Instrument}
+	}
+	return context.WithValue(c, DS_EXECUTOR_KEY, exe)
+}
+
+func dataSourceKey(c context.Context) (string, error) {
+	dsKey, _ := c.Value(DATASOURCE_KEY).(string)
+	if dsKey == "" {
+		dsKey = DEFAULT_DATASOURCE
+	}
+	if router, ok := shardRouter(dsKey); ok {
+		return router.Route(c)
+	}
+	return dsKey, nil
+}
+
+// DataSource returns the data source registered as dsKey.
+func DataSource(dsKey string) (*sqlx.DB, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	db, ok := DataSources[dsKey]
+	if !ok {
+		return nil, errors.Errorf("Unknown data source %s", dsKey)
+	}
+	return db, nil
+}
+
+func isReadOnly(c context.Context) bool {
+	readOnly, _ := c.Value(READONLY_KEY).(bool)
+	return readOnly
+}
+
+func currentTx(c context.Context) *boundTx {
+	bt, _ := c.Value(DS_TX_KEY).(*boundTx)
+	return bt
+}
+
+func inTx(c context.Context) bool {
+	return currentTx(c) != nil
 }
@@ -0,0 +1,93 @@
+package dstest
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lysu/go-misc/ds"
+	"golang.org/x/net/context"
+	_ "modernc.org/sqlite"
+)
+
+// Open connects to dsn and registers it as ds.DEFAULT_DATASOURCE until the
+// test ends.
+func Open(t testing.TB, driver, dsn string) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Connect(driver, dsn)
+	if err != nil {
+		t.Fatalf("dstest: open %s: %v", driver, err)
+	}
+	t.Cleanup(func() { db.Close() })
+	Register(t, db)
+	return db
+}
+
+// OpenEnv opens DSTEST_DRIVER/DSTEST_DSN when set and in-memory SQLite
+// otherwise.
+func OpenEnv(t testing.TB) *sqlx.DB {
+	driver, dsn := os.Getenv("DSTEST_DRIVER"), os.Getenv("DSTEST_DSN")
+	if driver == "" || dsn == "" {
+		return SQLite(t)
+	}
+	return Open(t, driver, dsn)
+}
+
+// SQLite opens a private in-memory database on the pure-Go driver.
+func SQLite(t testing.TB) *sqlx.DB {
+	t.Helper()
+	db := Open(t, "sqlite", ":memory:")
+	// Every connection to :memory: is a separate database.
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func Register(t testing.TB, db *sqlx.DB) {
+	prev, ok := ds.DataSources[ds.DEFAULT_DATASOURCE]
+	ds.RegisterDataSource(ds.DEFAULT_DATASOURCE, db)
+	t.Cleanup(func() {
+		if ok {
+			ds.RegisterDataSource(ds.DEFAULT_DATASOURCE, prev)
+		} else {
+			delete(ds.DataSources, ds.DEFAULT_DATASOURCE)
+		}
+	})
+}
+
+// CreateOutbox creates ds.OutboxTable in db, a SQLite database, which
+// cannot run the MySQL ds.OutboxSchema.
+func CreateOutbox(t testing.TB, db *sqlx.DB) {
+	t.Helper()
+	_, err := db.Exec(`CREATE TABLE ` + ds.OutboxTable + ` (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		topic TEXT NOT NULL,
+		msg_key TEXT NOT NULL DEFAULT '',
+		payload BLOB NOT NULL,
+		status INT NOT NULL DEFAULT 0,
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at DATETIME NOT NULL,
+		created_at DATETIME NOT NULL,
+		sent_at DATETIME NULL
+	)`)
+	if err != nil {
+		t.Fatalf("dstest: create outbox: %v", err)
+	}
+}
+
+// Begin opens a transaction on ds.DEFAULT_DATASOURCE that is rolled back
+// when the test ends. DoTx and DoNoTx under the returned context run inside
+// it, nested DoTx as savepoints.
+func Begin(t testing.TB) context.Context {
+	t.Helper()
+	db, ok := ds.DataSources[ds.DEFAULT_DATASOURCE]
+	if !ok {
+		t.Fatalf("dstest: no %s data source registered", ds.DEFAULT_DATASOURCE)
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("dstest: begin: %v", err)
+	}
+	t.Cleanup(func() { tx.Rollback() })
+	return ds.BindTx(context.Background(), ds.DEFAULT_DATASOURCE, tx)
+}
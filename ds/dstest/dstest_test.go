@@ -0,0 +1,48 @@
+package dstest_test
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestBegin(t *testing.T) {
+	dstest.SQLite(t)
+	c := dstest.Begin(t)
+
+	_, err := ds.Exec(c, "CREATE TABLE users (name TEXT)")
+	assert.NoError(t, err)
+
+	_, err = ds.DoTx(c, func(c context.Context) (interface{}, error) {
+		_, err := ds.Exec(c, "INSERT INTO users VALUES ('kept')")
+		if err != nil {
+			return nil, err
+		}
+		_, err = ds.DoTx(c, func(c context.Context) (interface{}, error) {
+			ds.Exec(c, "INSERT INTO users VALUES ('dropped')")
+			return nil, errors.New("rollback")
+		})
+		assert.Error(t, err)
+		return nil, nil
+	})
+	assert.NoError(t, err)
+
+	names, err := ds.Select[string](c, "SELECT name FROM users")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"kept"}, names)
+}
+
+func TestBeginRollsBack(t *testing.T) {
+	dstest.SQLite(t)
+	t.Run("write", func(t *testing.T) {
+		c := dstest.Begin(t)
+		_, err := ds.Exec(c, "CREATE TABLE users (name TEXT)")
+		assert.NoError(t, err)
+	})
+	_, err := ds.Exec(dstest.Begin(t), "SELECT name FROM users")
+	assert.Error(t, err)
+}
@@ -0,0 +1,166 @@
+package ds
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/net/context"
+)
+
+type ReplicaHealth struct {
+	Name    string        `json:"name"`
+	Healthy bool          `json:"healthy"`
+	Lag     time.Duration `json:"lag"`
+	Error   string        `json:"error,omitempty"`
+}
+
+type DataSourceHealth struct {
+	Healthy         bool            `json:"healthy"`
+	Error           string          `json:"error,omitempty"`
+	Latency         time.Duration   `json:"latency"`
+	OpenConnections int             `json:"open_connections"`
+	InUse           int             `json:"in_use"`
+	WaitCount       int64           `json:"wait_count"`
+	Replicas        []ReplicaHealth `json:"replicas,omitempty"`
+}
+
+type HealthReport struct {
+	Healthy     bool                        `json:"healthy"`
+	Checked     time.Time                   `json:"checked"`
+	DataSources map[string]DataSourceHealth `json:"datasources"`
+}
+
+// HealthChecker pings every registered data source on an interval and
+// serves the latest report over HTTP, with 503 while any primary is down.
+type HealthChecker struct {
+	Interval time.Duration
+	Timeout  time.Duration
+
+	mu     sync.RWMutex
+	report HealthReport
+	stop   chan struct{}
+}
+
+// NewHealthChecker checks every 10 seconds and gives pings 2 seconds when
+// interval or timeout is not positive.
+func NewHealthChecker(interval, timeout time.Duration) *HealthChecker {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	return &HealthChecker{Interval: interval, Timeout: timeout}
+}
+
+func (h *HealthChecker) Check(c context.Context) HealthReport {
+	report := HealthReport{
+		Healthy:     true,
+		Checked:     time.Now(),
+		DataSources: map[string]DataSourceHealth{},
+	}
+	registry.RLock()
+	dataSources := make(map[string]*sqlx.DB, len(DataSources))
+	for name, db := range DataSources {
+		dataSources[name] = db
+	}
+	replicas := make(map[string]*ReplicaSet, len(Replicas))
+	for name, rs := range Replicas {
+		replicas[name] = rs
+	}
+	registry.RUnlock()
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	for name, db := range dataSources {
+		pc, cancel := context.WithTimeout(c, timeout)
+		start := time.Now()
+		err := db.PingContext(pc)
+		cancel()
+		stats := db.Stats()
+		health := DataSourceHealth{
+			Healthy:         err == nil,
+			Latency:         time.Since(start),
+			OpenConnections: stats.OpenConnections,
+			InUse:           stats.InUse,
+			WaitCount:       stats.WaitCount,
+		}
+		if err != nil {
+			health.Error = err.Error()
+			report.Healthy = false
+		}
+		if rs, ok := replicas[name]; ok {
+			for _, st := range rs.Status() {
+				rh := ReplicaHealth{Name: st.Name, Healthy: st.Healthy, Lag: st.Lag}
+				if st.Err != nil {
+					rh.Error = st.Err.Error()
+				}
+				health.Replicas = append(health.Replicas, rh)
+			}
+		}
+		report.DataSources[name] = health
+	}
+	h.mu.Lock()
+	h.report = report
+	h.mu.Unlock()
+	return report
+}
+
+func (h *HealthChecker) Report() HealthReport {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.report
+}
+
+func (h *HealthChecker) Start() {
+	h.mu.Lock()
+	if h.stop != nil {
+		h.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	h.stop = stop
+	h.mu.Unlock()
+	h.Check(context.Background())
+	interval := h.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.Check(context.Background())
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (h *HealthChecker) Stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+}
+
+func (h *HealthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := h.Report()
+	if report.Checked.IsZero() {
+		report = h.Check(r.Context())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
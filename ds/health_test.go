@@ -0,0 +1,72 @@
+package ds_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestHealthChecker(t *testing.T) {
+	db := dstest.SQLite(t)
+	r1 := openNamed(t, "r1")
+	ds.RegisterReplicas(ds.DEFAULT_DATASOURCE, ds.NewReplicaSet(nil, 0, ds.Replica{Name: "r1", DB: r1}))
+	defer delete(ds.Replicas, ds.DEFAULT_DATASOURCE)
+	h := ds.NewHealthChecker(0, 0)
+	assert.Equal(t, 10*time.Second, h.Interval)
+	assert.Equal(t, 2*time.Second, h.Timeout)
+
+	serve := func() (int, ds.HealthReport) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		var report ds.HealthReport
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+		return w.Code, report
+	}
+	code, report := serve()
+	assert.Equal(t, http.StatusOK, code, "the first request checks")
+	assert.True(t, report.Healthy)
+	if assert.Contains(t, report.DataSources, ds.DEFAULT_DATASOURCE) {
+		health := report.DataSources[ds.DEFAULT_DATASOURCE]
+		assert.True(t, health.Healthy)
+		assert.Equal(t, []ds.ReplicaHealth{{Name: "r1", Healthy: true}}, health.Replicas)
+	}
+
+	db.Close()
+	code, _ = serve()
+	assert.Equal(t, http.StatusOK, code, "later requests serve the last report")
+	report = h.Check(context.Background())
+	assert.False(t, report.Healthy)
+	assert.NotEmpty(t, report.DataSources[ds.DEFAULT_DATASOURCE].Error)
+	code, report = serve()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, report.Healthy)
+}
+
+func TestHealthCheckerDuringClose(t *testing.T) {
+	for _, name := range []string{"health_a", "health_b"} {
+		db, err := sqlx.Connect("sqlite", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds.RegisterDataSource(name, db)
+	}
+	h := &ds.HealthChecker{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			h.Check(context.Background())
+		}
+	}()
+	assert.NoError(t, ds.Close())
+	<-done
+	assert.Empty(t, ds.DataSources)
+}
@@ -0,0 +1,209 @@
+package ds
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Instrument, when set, wraps every executor handed out by DoTx and DoNoTx.
+var Instrument *Instrumentation
+
+type Metrics interface {
+	ObserveQuery(ds, op string, d time.Duration, err error)
+	// ObserveTx is told whether a transaction tried to commit or rolled
+	// back, and what Commit or Rollback returned.
+	ObserveTx(ds string, commit bool, err error)
+}
+
+type Instrumentation struct {
+	// Queries taking SlowThreshold or longer are logged at Warn, the others
+	// at Debug. Zero logs none at Warn.
+	SlowThreshold time.Duration
+	Logger        *slog.Logger
+	// Redact rewrites args before they are logged, RedactArgs by default.
+	Redact  func(query string, args []interface{}) []interface{}
+	Metrics Metrics
+}
+
+func RedactArgs(query string, args []interface{}) []interface{} {
+	redacted := make([]interface{}, len(args))
+	for i := range args {
+		redacted[i] = "?"
+	}
+	return redacted
+}
+
+func (i *Instrumentation) observe(ds, op, query string, args []interface{}, start time.Time, err error) {
+	d := time.Since(start)
+	if i.Metrics != nil {
+		i.Metrics.ObserveQuery(ds, op, d, err)
+	}
+	if i.Logger == nil {
+		return
+	}
+	redact := i.Redact
+	if redact == nil {
+		redact = RedactArgs
+	}
+	attrs := []interface{}{
+		"ds", ds,
+		"op", op,
+		"sql", query,
+		"args", redact(query, args),
+		"duration", d,
+	}
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	if i.SlowThreshold > 0 && d >= i.SlowThreshold {
+		i.Logger.Warn("slow query", attrs...)
+	} else {
+		i.Logger.Debug("query", attrs...)
+	}
+}
+
+func (i *Instrumentation) endTx(ds string, commit bool, err error) {
+	if i != nil && i.Metrics != nil {
+		i.Metrics.ObserveTx(ds, commit, err)
+	}
+}
+
+type instrumentedExecutor struct {
+	IExecutor
+	ds   string
+	inst *Instrumentation
+}
+
+func (e *instrumentedExecutor) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := e.IExecutor.Query(query, args...)
+	e.inst.observe(e.ds, "query", query, args, start, err)
+	return rows, err
+}
+
+func (e *instrumentedExecutor) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	start := time.Now()
+	rows, err := e.IExecutor.Queryx(query, args...)
+	e.inst.observe(e.ds, "query", query, args, start, err)
+	return rows, err
+}
+
+func (e *instrumentedExecutor) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	start := time.Now()
+	row := e.IExecutor.QueryRowx(query, args...)
+	e.inst.observe(e.ds, "query", query, args, start, row.Err())
+	return row
+}
+
+func (e *instrumentedExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := e.IExecutor.Exec(query, args...)
+	e.inst.observe(e.ds, "exec", query, args, start, err)
+	return result, err
+}
+
+var DefaultBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+type Histogram struct {
+	Buckets []time.Duration
+	// Counts has one extra slot for observations above the last bucket.
+	Counts []int64
+	Sum    time.Duration
+}
+
+type DataSourceStats struct {
+	Queries int64
+	Errors  int64
+	Commits int64
+	// CommitErrors counts the commits that failed; they are not Commits.
+	CommitErrors int64
+	Rollbacks    int64
+	Latency      Histogram
+}
+
+// Stats is an in-memory Metrics; it implements expvar.Var so it can be
+// published with expvar.Publish.
+type Stats struct {
+	buckets []time.Duration
+	mu      sync.Mutex
+	stats   map[string]*DataSourceStats
+}
+
+func NewStats(buckets ...time.Duration) *Stats {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	return &Stats{buckets: buckets, stats: map[string]*DataSourceStats{}}
+}
+
+func (s *Stats) get(ds string) *DataSourceStats {
+	st, ok := s.stats[ds]
+	if !ok {
+		st = &DataSourceStats{Latency: Histogram{
+			Buckets: s.buckets,
+			Counts:  make([]int64, len(s.buckets)+1),
+		}}
+		s.stats[ds] = st
+	}
+	return st
+}
+
+func (s *Stats) ObserveQuery(ds, op string, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.get(ds)
+	st.Queries++
+	if err != nil && err != sql.ErrNoRows {
+		st.Errors++
+	}
+	i := 0
+	for i < len(s.buckets) && d > s.buckets[i] {
+		i++
+	}
+	st.Latency.Counts[i]++
+	st.Latency.Sum += d
+}
+
+func (s *Stats) ObserveTx(ds string, commit bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case !commit:
+		s.get(ds).Rollbacks++
+	case err != nil:
+		s.get(ds).CommitErrors++
+	default:
+		s.get(ds).Commits++
+	}
+}
+
+func (s *Stats) Snapshot() map[string]DataSourceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := make(map[string]DataSourceStats, len(s.stats))
+	for ds, st := range s.stats {
+		cp := *st
+		cp.Latency.Counts = append([]int64(nil), st.Latency.Counts...)
+		snapshot[ds] = cp
+	}
+	return snapshot
+}
+
+func (s *Stats) String() string {
+	b, _ := json.Marshal(s.Snapshot())
+	return string(b)
+}
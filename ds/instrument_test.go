@@ -0,0 +1,108 @@
+package ds_test
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type txEvent struct {
+	commit bool
+	failed bool
+}
+
+type fakeMetrics struct {
+	ops []string
+	txs []txEvent
+}
+
+func (m *fakeMetrics) ObserveQuery(ds, op string, d time.Duration, err error) {
+	m.ops = append(m.ops, op)
+}
+
+func (m *fakeMetrics) ObserveTx(ds string, commit bool, err error) {
+	m.txs = append(m.txs, txEvent{commit: commit, failed: err != nil})
+}
+
+func TestInstrument(t *testing.T) {
+	dstest.SQLite(t)
+	metrics := &fakeMetrics{}
+	var logs bytes.Buffer
+	ds.Instrument = &ds.Instrumentation{
+		Logger:  slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		Metrics: metrics,
+	}
+	defer func() { ds.Instrument = nil }()
+	c := context.Background()
+
+	_, err := ds.DoNoTx(c, func(c context.Context) (interface{}, error) {
+		if _, err := ds.Exec(c, "CREATE TABLE kv (k TEXT PRIMARY KEY, v TEXT)"); err != nil {
+			return nil, err
+		}
+		return ds.Get[int](c, "SELECT COUNT(*) FROM kv WHERE v = ?", "secret")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"exec", "query"}, metrics.ops)
+	assert.Contains(t, logs.String(), "SELECT COUNT(*) FROM kv")
+	assert.NotContains(t, logs.String(), "secret", "args are redacted")
+	assert.NotContains(t, logs.String(), "slow query", "no threshold, no slow queries")
+
+	_, err = ds.DoTx(c, func(c context.Context) (interface{}, error) {
+		return ds.Exec(c, "INSERT INTO kv VALUES ('a', '1')")
+	})
+	assert.NoError(t, err)
+	_, err = ds.DoTx(c, func(c context.Context) (interface{}, error) {
+		return nil, errors.New("boom")
+	})
+	assert.Error(t, err)
+	_, err = ds.DoTx(c, func(c context.Context) (interface{}, error) {
+		// Ends the transaction behind DoTx's back, so Commit fails.
+		return ds.Exec(c, "COMMIT")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []txEvent{{commit: true}, {commit: false}, {commit: true, failed: true}}, metrics.txs)
+}
+
+func TestInstrumentSlowThreshold(t *testing.T) {
+	dstest.SQLite(t)
+	var logs bytes.Buffer
+	ds.Instrument = &ds.Instrumentation{
+		SlowThreshold: time.Hour,
+		Logger:        slog.New(slog.NewTextHandler(&logs, nil)),
+	}
+	defer func() { ds.Instrument = nil }()
+
+	_, err := ds.Exec(context.Background(), "CREATE TABLE kv (k TEXT)")
+	assert.NoError(t, err)
+	assert.Empty(t, logs.String())
+
+	ds.Instrument.SlowThreshold = time.Nanosecond
+	_, err = ds.Exec(context.Background(), "INSERT INTO kv VALUES ('a')")
+	assert.NoError(t, err)
+	assert.Contains(t, logs.String(), "level=WARN msg=\"slow query\"")
+}
+
+func TestStats(t *testing.T) {
+	s := ds.NewStats(time.Millisecond, time.Second)
+	s.ObserveQuery("a", "query", 500*time.Microsecond, nil)
+	s.ObserveQuery("a", "exec", 2*time.Second, errors.New("boom"))
+	s.ObserveTx("a", true, nil)
+	s.ObserveTx("a", true, errors.New("commit failed"))
+	s.ObserveTx("a", false, nil)
+
+	st := s.Snapshot()["a"]
+	assert.Equal(t, int64(2), st.Queries)
+	assert.Equal(t, int64(1), st.Errors)
+	assert.Equal(t, int64(1), st.Commits)
+	assert.Equal(t, int64(1), st.CommitErrors)
+	assert.Equal(t, int64(1), st.Rollbacks)
+	assert.Equal(t, []int64{1, 0, 1}, st.Latency.Counts)
+	assert.Contains(t, s.String(), `"CommitErrors":1`)
+}
@@ -0,0 +1,79 @@
+package lock
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = fc.now.Add(d)
+}
+
+func TestLease(t *testing.T) {
+	db := dstest.SQLite(t)
+	db.MustExec(LeaseSchema())
+	clock := &fakeClock{now: time.Now()}
+	// The renewal ticker never fires within the test; extend stands in.
+	l := &leaseLocker{ds: ds.DEFAULT_DATASOURCE, ttl: time.Hour, now: clock.Now}
+	c := context.Background()
+
+	first, err := l.TryLock(c, "job")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), first.Token())
+	_, err = l.TryLock(c, "job")
+	assert.Equal(t, ErrNotAcquired, err)
+
+	// Renewal keeps the lease past its ttl.
+	expires := clock.Now().Add(time.Hour)
+	clock.Advance(50 * time.Minute)
+	assert.True(t, first.(*lease).extend(&expires))
+	clock.Advance(50 * time.Minute)
+	_, err = l.TryLock(c, "job")
+	assert.Equal(t, ErrNotAcquired, err)
+
+	// Without it the lease expires and goes to the next owner.
+	clock.Advance(2 * time.Hour)
+	second, err := l.TryLock(c, "job")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), second.Token())
+	assert.False(t, first.(*lease).extend(&expires), "taken over")
+	assert.NoError(t, first.Unlock(), "a no-op once taken over")
+	_, err = l.TryLock(c, "job")
+	assert.Equal(t, ErrNotAcquired, err)
+
+	assert.NoError(t, second.Unlock())
+	third, err := l.TryLock(c, "job")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), third.Token())
+	assert.NoError(t, third.Unlock())
+}
+
+func TestIsDuplicate(t *testing.T) {
+	assert.False(t, isDuplicate(nil))
+	assert.True(t, isDuplicate(sqlStateError("23505")))
+	assert.False(t, isDuplicate(sqlStateError("40001")))
+}
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "pq: " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
@@ -0,0 +1,370 @@
+package lock
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	stderrors "errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"golang.org/x/net/context"
+)
+
+var ErrNotAcquired = errors.New("Lock not acquired")
+
+type Lock interface {
+	Name() string
+	// Token is a fencing token that grows with every acquisition of the
+	// same name. Session locks have none and return 0.
+	Token() int64
+	// Lost is closed once the lock can no longer be trusted to be held.
+	Lost() <-chan struct{}
+	Unlock() error
+}
+
+type Locker interface {
+	Lock(c context.Context, name string) (Lock, error)
+	// TryLock returns ErrNotAcquired instead of waiting.
+	TryLock(c context.Context, name string) (Lock, error)
+}
+
+var PollInterval = 500 * time.Millisecond
+
+// RunExclusive runs f while holding name. The context passed to f is
+// cancelled when c is done or the lock is lost. The lock is released as
+// soon as f returns or c is done, whichever comes first, so f must stop
+// when its context is.
+func RunExclusive(c context.Context, l Locker, name string, f func(c context.Context) error) error {
+	lk, err := l.Lock(c, name)
+	if err != nil {
+		return err
+	}
+	defer lk.Unlock()
+	fc, cancel := context.WithCancel(c)
+	defer cancel()
+	go func() {
+		select {
+		case <-lk.Lost():
+			cancel()
+		case <-fc.Done():
+			if c.Err() != nil {
+				lk.Unlock()
+			}
+		}
+	}()
+	return f(fc)
+}
+
+func poll(c context.Context, try func() (Lock, error)) (Lock, error) {
+	for {
+		lk, err := try()
+		if err != ErrNotAcquired {
+			return lk, err
+		}
+		select {
+		case <-c.Done():
+			return nil, c.Err()
+		case <-time.After(PollInterval):
+		}
+	}
+}
+
+// sessionLock is held by a dedicated connection; the server drops it when
+// that connection goes away, which the keepalive notices.
+type sessionLock struct {
+	name    string
+	conn    *sql.Conn
+	release func(conn *sql.Conn) error
+	lost    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newSessionLock(name string, conn *sql.Conn, release func(conn *sql.Conn) error) *sessionLock {
+	lk := &sessionLock{
+		name:    name,
+		conn:    conn,
+		release: release,
+		lost:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go lk.keepalive()
+	return lk
+}
+
+func (lk *sessionLock) keepalive() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := lk.conn.PingContext(context.Background()); err != nil {
+				close(lk.lost)
+				return
+			}
+		case <-lk.done:
+			return
+		}
+	}
+}
+
+func (lk *sessionLock) Name() string {
+	return lk.name
+}
+
+func (lk *sessionLock) Token() int64 {
+	return 0
+}
+
+func (lk *sessionLock) Lost() <-chan struct{} {
+	return lk.lost
+}
+
+func (lk *sessionLock) Unlock() (err error) {
+	lk.once.Do(func() {
+		close(lk.done)
+		err = lk.release(lk.conn)
+		lk.conn.Close()
+	})
+	return
+}
+
+type mysqlLocker struct {
+	ds string
+}
+
+// NewMySQL locks with GET_LOCK on the ds data source. MySQL limits lock
+// names to 64 characters.
+func NewMySQL(ds string) Locker {
+	return &mysqlLocker{ds: ds}
+}
+
+func (l *mysqlLocker) Lock(c context.Context, name string) (Lock, error) {
+	return poll(c, func() (Lock, error) { return l.TryLock(c, name) })
+}
+
+func (l *mysqlLocker) TryLock(c context.Context, name string) (Lock, error) {
+	return trySession(c, l.ds, name, "SELECT GET_LOCK(?, 0)", "SELECT RELEASE_LOCK(?)")
+}
+
+type postgresLocker struct {
+	ds string
+}
+
+// NewPostgres locks with session advisory locks keyed by hashtext(name).
+func NewPostgres(ds string) Locker {
+	return &postgresLocker{ds: ds}
+}
+
+func (l *postgresLocker) Lock(c context.Context, name string) (Lock, error) {
+	return poll(c, func() (Lock, error) { return l.TryLock(c, name) })
+}
+
+func (l *postgresLocker) TryLock(c context.Context, name string) (Lock, error) {
+	return trySession(c, l.ds, name,
+		"SELECT CASE WHEN pg_try_advisory_lock(hashtext($1)) THEN 1 ELSE 0 END",
+		"SELECT pg_advisory_unlock(hashtext($1))")
+}
+
+func trySession(c context.Context, dsName, name, acquire, release string) (Lock, error) {
+	db, err := ds.DataSource(dsName)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(c)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var got sql.NullInt64
+	if err = conn.QueryRowContext(c, acquire, name).Scan(&got); err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+	if got.Int64 != 1 {
+		conn.Close()
+		return nil, ErrNotAcquired
+	}
+	return newSessionLock(name, conn, func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(context.Background(), release, name)
+		return errors.Trace(err)
+	}), nil
+}
+
+var LeaseTable = "ds_lock"
+
+// LeaseSchema returns the statement creating LeaseTable.
+func LeaseSchema() string {
+	return "CREATE TABLE " + LeaseTable + ` (
+	name VARCHAR(255) NOT NULL PRIMARY KEY,
+	owner VARCHAR(64) NOT NULL,
+	token BIGINT NOT NULL,
+	expires_at DATETIME NOT NULL
+)`
+}
+
+type leaseLocker struct {
+	ds  string
+	ttl time.Duration
+	now func() time.Time
+}
+
+// NewLease locks with rows in LeaseTable that expire after ttl unless
+// renewed. Token is a fencing token. Expiry uses the clocks of the
+// competing processes, so they must be roughly in sync. The lease is
+// renewed every ttl/3, so ttl must be at least 3ns.
+func NewLease(ds string, ttl time.Duration) (Locker, error) {
+	if ttl/3 <= 0 {
+		return nil, errors.Errorf("Bad lease ttl %s", ttl)
+	}
+	return &leaseLocker{ds: ds, ttl: ttl, now: time.Now}, nil
+}
+
+func (l *leaseLocker) Lock(c context.Context, name string) (Lock, error) {
+	return poll(c, func() (Lock, error) { return l.TryLock(c, name) })
+}
+
+func (l *leaseLocker) TryLock(c context.Context, name string) (Lock, error) {
+	owner, err := newOwner()
+	if err != nil {
+		return nil, err
+	}
+	// Lease rows are committed on their own, never in the caller's tx.
+	c = ds.WithDataSource(context.Background(), l.ds)
+	token, err := ds.InTx(c, func(c context.Context) (int64, error) {
+		now := l.now()
+		result, err := ds.Exec(c, l.rebind("UPDATE "+LeaseTable+
+			" SET owner = ?, token = token + 1, expires_at = ? WHERE name = ? AND expires_at < ?"),
+			owner, now.Add(l.ttl), name, now)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			_, err = ds.Exec(c, l.rebind("INSERT INTO "+LeaseTable+
+				" (name, owner, token, expires_at) VALUES (?, ?, 1, ?)"), name, owner, now.Add(l.ttl))
+			if isDuplicate(err) {
+				return 0, ErrNotAcquired
+			}
+			if err != nil {
+				return 0, errors.Trace(err)
+			}
+		}
+		return ds.Get[int64](c, l.rebind("SELECT token FROM "+LeaseTable+" WHERE name = ? AND owner = ?"), name, owner)
+	})
+	if err != nil {
+		return nil, err
+	}
+	lk := &lease{
+		locker: l,
+		c:      c,
+		name:   name,
+		owner:  owner,
+		token:  token,
+		lost:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go lk.renew()
+	return lk, nil
+}
+
+type lease struct {
+	locker *leaseLocker
+	c      context.Context
+	name   string
+	owner  string
+	token  int64
+	lost   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (lk *lease) renew() {
+	ticker := time.NewTicker(lk.locker.ttl / 3)
+	defer ticker.Stop()
+	expires := lk.locker.now().Add(lk.locker.ttl)
+	for {
+		select {
+		case <-ticker.C:
+			if !lk.extend(&expires) {
+				close(lk.lost)
+				return
+			}
+		case <-lk.done:
+			return
+		}
+	}
+}
+
+// extend moves the expiry of the lease, last known to be expires, ttl past
+// now. It returns false once the lease is taken over, or has expired
+// without being renewed.
+func (lk *lease) extend(expires *time.Time) bool {
+	now := lk.locker.now()
+	result, err := ds.Exec(lk.c, lk.locker.rebind("UPDATE "+LeaseTable+
+		" SET expires_at = ? WHERE name = ? AND owner = ? AND token = ?"),
+		now.Add(lk.locker.ttl), lk.name, lk.owner, lk.token)
+	if err != nil {
+		return !now.After(*expires)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false
+	}
+	*expires = now.Add(lk.locker.ttl)
+	return true
+}
+
+func (lk *lease) Name() string {
+	return lk.name
+}
+
+func (lk *lease) Token() int64 {
+	return lk.token
+}
+
+func (lk *lease) Lost() <-chan struct{} {
+	return lk.lost
+}
+
+// Unlock expires the row rather than deleting it so tokens keep growing.
+func (lk *lease) Unlock() (err error) {
+	lk.once.Do(func() {
+		close(lk.done)
+		_, err = ds.Exec(lk.c, lk.locker.rebind("UPDATE "+LeaseTable+
+			" SET owner = '', expires_at = ? WHERE name = ? AND owner = ? AND token = ?"),
+			lk.locker.now().Add(-time.Second), lk.name, lk.owner, lk.token)
+		err = errors.Trace(err)
+	})
+	return
+}
+
+func (l *leaseLocker) rebind(query string) string {
+	if db, err := ds.DataSource(l.ds); err == nil {
+		return db.Rebind(query)
+	}
+	return query
+}
+
+// isDuplicate tells unique key violations from other errors by SQLSTATE
+// where the driver has it, and by message for MySQL and SQLite.
+func isDuplicate(err error) bool {
+	if err == nil {
+		return false
+	}
+	var state interface{ SQLState() string }
+	if stderrors.As(err, &state) {
+		return state.SQLState() == "23505"
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "Error 1062") || strings.Contains(msg, "UNIQUE constraint failed")
+}
+
+func newOwner() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Trace(err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,102 @@
+package lock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/lysu/go-misc/ds/lock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func newLease(t *testing.T, ttl time.Duration) lock.Locker {
+	l, err := lock.NewLease(ds.DEFAULT_DATASOURCE, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestNewLeaseBadTTL(t *testing.T) {
+	for _, ttl := range []time.Duration{0, -time.Second, 2} {
+		_, err := lock.NewLease(ds.DEFAULT_DATASOURCE, ttl)
+		assert.Error(t, err, "ttl %d", ttl)
+	}
+}
+
+func TestLeaseInsertError(t *testing.T) {
+	db := dstest.SQLite(t)
+	db.MustExec(lock.LeaseSchema())
+	db.MustExec(`CREATE TRIGGER full BEFORE INSERT ON ds_lock BEGIN SELECT RAISE(ABORT, 'disk full'); END`)
+	_, err := newLease(t, time.Minute).TryLock(context.Background(), "job")
+	assert.Error(t, err)
+	assert.NotEqual(t, lock.ErrNotAcquired, err)
+}
+
+func TestRunExclusive(t *testing.T) {
+	db := dstest.SQLite(t)
+	db.MustExec(lock.LeaseSchema())
+	l := newLease(t, time.Second)
+
+	ran := false
+	err := lock.RunExclusive(context.Background(), l, "job", func(c context.Context) error {
+		ran = true
+		waiting, cancel := context.WithTimeout(c, 50*time.Millisecond)
+		defer cancel()
+		_, err := l.Lock(waiting, "job")
+		assert.Equal(t, context.DeadlineExceeded, err)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, ran)
+
+	lk, err := l.TryLock(context.Background(), "job")
+	assert.NoError(t, err)
+	assert.NoError(t, lk.Unlock())
+}
+
+func TestRunExclusiveCancel(t *testing.T) {
+	db := dstest.SQLite(t)
+	db.MustExec(lock.LeaseSchema())
+	l := newLease(t, time.Minute)
+
+	c, cancel := context.WithCancel(context.Background())
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- lock.RunExclusive(c, l, "job", func(c context.Context) error {
+			close(started)
+			// Slow to notice it was cancelled.
+			<-release
+			return c.Err()
+		})
+	}()
+	<-started
+	_, err := l.TryLock(context.Background(), "job")
+	assert.Equal(t, lock.ErrNotAcquired, err)
+
+	cancel()
+	waiting, stop := context.WithTimeout(context.Background(), time.Second)
+	defer stop()
+	lk, err := l.Lock(waiting, "job")
+	if assert.NoError(t, err, "released on cancel") {
+		assert.NoError(t, lk.Unlock())
+	}
+	close(release)
+	assert.Equal(t, context.Canceled, <-done)
+}
+
+func TestLeaseTable(t *testing.T) {
+	defer func(table string) { lock.LeaseTable = table }(lock.LeaseTable)
+	lock.LeaseTable = "app_lock"
+	db := dstest.SQLite(t)
+	db.MustExec(lock.LeaseSchema())
+	lk, err := newLease(t, time.Minute).TryLock(context.Background(), "job")
+	assert.NoError(t, err)
+	var n int
+	assert.NoError(t, db.Get(&n, "SELECT COUNT(*) FROM app_lock"))
+	assert.Equal(t, 1, n)
+	assert.NoError(t, lk.Unlock())
+}
@@ -0,0 +1,364 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/lock"
+	"golang.org/x/net/context"
+)
+
+var fileRe = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	*Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type Dialect struct {
+	Name string
+	// TransactionalDDL runs each migration in DoTx instead of DoNoTx.
+	TransactionalDDL bool
+	Locker           func(ds string) lock.Locker
+}
+
+var MySQL = &Dialect{
+	Name:   "mysql",
+	Locker: lock.NewMySQL,
+}
+
+var Postgres = &Dialect{
+	Name:             "postgres",
+	TransactionalDDL: true,
+	Locker:           lock.NewPostgres,
+}
+
+// SQLite has no advisory locks; its single writer serializes migrators.
+var SQLite = &Dialect{
+	Name:             "sqlite",
+	TransactionalDDL: true,
+}
+
+type Runner struct {
+	DataSource string
+	Dialect    *Dialect
+	Table      string
+	// DryRun writes the SQL that would run to Out instead of executing it.
+	DryRun     bool
+	Out        io.Writer
+	migrations []*Migration
+}
+
+// New reads <version>_<name>.up.sql and .down.sql files from dir of fsys.
+func New(dataSource string, dialect *Dialect, fsys fs.FS, dir string) (*Runner, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		m := fileRe.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		body, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		} else if migration.Name != m[2] {
+			return nil, errors.Errorf("Migration %d has two names: %s and %s", version, migration.Name, m[2])
+		}
+		if m[3] == "up" {
+			migration.Up = string(body)
+		} else {
+			migration.Down = string(body)
+		}
+	}
+	r := &Runner{
+		DataSource: dataSource,
+		Dialect:    dialect,
+		Table:      "schema_migrations",
+		Out:        os.Stdout,
+	}
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, errors.Errorf("Migration %d_%s has no up file", migration.Version, migration.Name)
+		}
+		r.migrations = append(r.migrations, migration)
+	}
+	sort.Slice(r.migrations, func(i, j int) bool {
+		return r.migrations[i].Version < r.migrations[j].Version
+	})
+	return r, nil
+}
+
+func (r *Runner) Migrations() []*Migration {
+	return r.migrations
+}
+
+func (r *Runner) Status(c context.Context) ([]MigrationStatus, error) {
+	c = r.context(c)
+	if !r.DryRun {
+		if err := r.ensureTable(c); err != nil {
+			return nil, err
+		}
+	}
+	applied, err := r.applied(c)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, len(r.migrations))
+	for i, migration := range r.migrations {
+		appliedAt, ok := applied[migration.Version]
+		status[i] = MigrationStatus{Migration: migration, Applied: ok, AppliedAt: appliedAt}
+	}
+	return status, nil
+}
+
+// Up applies every pending migration in version order.
+func (r *Runner) Up(c context.Context) (done []*Migration, err error) {
+	err = r.locked(c, func(c context.Context) error {
+		applied, err := r.applied(c)
+		if err != nil {
+			return err
+		}
+		for _, migration := range r.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err = r.apply(c, migration, true); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return
+}
+
+// Down reverts the n most recently applied migrations.
+func (r *Runner) Down(c context.Context, n int) (done []*Migration, err error) {
+	err = r.locked(c, func(c context.Context) error {
+		applied, err := r.applied(c)
+		if err != nil {
+			return err
+		}
+		for i := len(r.migrations) - 1; i >= 0 && len(done) < n; i-- {
+			migration := r.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if migration.Down == "" {
+				return errors.Errorf("Migration %d_%s has no down file", migration.Version, migration.Name)
+			}
+			if err = r.apply(c, migration, false); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return
+}
+
+// context keeps the one-off SQL of migrations out of statement caches.
+func (r *Runner) context(c context.Context) context.Context {
+	return ds.NoStmtCache(ds.WithDataSource(c, r.DataSource))
+}
+
+func (r *Runner) locked(c context.Context, f func(c context.Context) error) error {
+	c = r.context(c)
+	if r.DryRun {
+		return f(c)
+	}
+	if err := r.ensureTable(c); err != nil {
+		return err
+	}
+	if r.Dialect.Locker == nil {
+		return f(c)
+	}
+	return lock.RunExclusive(c, r.Dialect.Locker(r.DataSource), "migrate:"+r.DataSource, f)
+}
+
+func (r *Runner) ensureTable(c context.Context) error {
+	_, err := ds.Exec(c, "CREATE TABLE IF NOT EXISTS "+r.Table+
+		" (version BIGINT PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at TIMESTAMP NOT NULL)")
+	return errors.Trace(err)
+}
+
+func (r *Runner) applied(c context.Context) (map[int64]time.Time, error) {
+	rows, err := ds.Select[struct {
+		Version   int64     `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}](c, "SELECT version, applied_at FROM "+r.Table)
+	if err != nil {
+		if r.DryRun {
+			return map[int64]time.Time{}, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	applied := make(map[int64]time.Time, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+	return applied, nil
+}
+
+func (r *Runner) apply(c context.Context, migration *Migration, up bool) error {
+	body, direction := migration.Up, "up"
+	if !up {
+		body, direction = migration.Down, "down"
+	}
+	if r.DryRun {
+		_, err := fmt.Fprintf(r.Out, "-- %d_%s (%s)\n%s\n", migration.Version, migration.Name, direction, body)
+		return errors.Trace(err)
+	}
+	run := ds.DoNoTx
+	if r.Dialect.TransactionalDDL {
+		run = func(c context.Context, f func(c context.Context) (interface{}, error)) (interface{}, error) {
+			return ds.DoTx(c, f)
+		}
+	}
+	_, err := run(c, func(c context.Context) (interface{}, error) {
+		exe, err := ds.Executor(c)
+		if err != nil {
+			return nil, err
+		}
+		for _, stmt := range SplitStatements(body) {
+			if _, err = exe.Exec(stmt); err != nil {
+				return nil, errors.Annotatef(err, "migration %d_%s (%s)", migration.Version, migration.Name, direction)
+			}
+		}
+		return nil, r.record(exe, migration, up)
+	})
+	return err
+}
+
+func (r *Runner) record(exe ds.IExecutor, migration *Migration, up bool) error {
+	var err error
+	if up {
+		_, err = exe.Exec(exe.Rebind("INSERT INTO "+r.Table+" (version, name, applied_at) VALUES (?, ?, ?)"),
+			migration.Version, migration.Name, time.Now())
+	} else {
+		_, err = exe.Exec(exe.Rebind("DELETE FROM "+r.Table+" WHERE version = ?"), migration.Version)
+	}
+	return errors.Trace(err)
+}
+
+// SplitStatements splits body on semicolons outside quotes, comments and
+// Postgres dollar quoted bodies ($$ ... $$ or $tag$ ... $tag$). A backslash
+// escapes the next character in quotes as in MySQL, so Postgres strings
+// ending in a backslash need E'...' syntax. -- comments are dropped; block
+// comments are kept, since MySQL reads hints from them. DELIMITER is not
+// understood.
+func SplitStatements(body string) []string {
+	var (
+		stmts []string
+		cur   strings.Builder
+		quote rune
+	)
+	runes := []rune(body)
+	for i := 0; i < len(runes); i++ {
+		ch := runes[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' && quote != '`' && i+1 < len(runes) {
+				cur.WriteRune(ch)
+				i++
+				ch = runes[i]
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			quote = ch
+		case ch == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for i+1 < len(runes) && runes[i+1] != '\n' {
+				i++
+			}
+			continue
+		case ch == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			end := indexFrom(runes, i+2, "*/") + 2
+			cur.WriteString(string(runes[i:end]))
+			i = end - 1
+			continue
+		case ch == '$' && (i == 0 || !isIdent(runes[i-1])):
+			if tag := dollarTag(runes[i:]); tag != "" {
+				n := len([]rune(tag))
+				end := indexFrom(runes, i+n, tag) + n
+				cur.WriteString(string(runes[i:end]))
+				i = end - 1
+				continue
+			}
+		case ch == ';':
+			if stmt := strings.TrimSpace(cur.String()); stmt != "" {
+				stmts = append(stmts, stmt)
+			}
+			cur.Reset()
+			continue
+		}
+		cur.WriteRune(ch)
+	}
+	if stmt := strings.TrimSpace(cur.String()); stmt != "" {
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
+
+// indexFrom returns the index of sub in runes from from on, or where it
+// would start if it were appended to runes.
+func indexFrom(runes []rune, from int, sub string) int {
+	if from > len(runes) {
+		from = len(runes)
+	}
+	subRunes := []rune(sub)
+	for i := from; i+len(subRunes) <= len(runes); i++ {
+		if string(runes[i:i+len(subRunes)]) == sub {
+			return i
+		}
+	}
+	return len(runes) - len(subRunes)
+}
+
+// dollarTag returns the $tag$ that runes start with, if any.
+func dollarTag(runes []rune) string {
+	for i := 1; i < len(runes); i++ {
+		switch {
+		case runes[i] == '$':
+			return string(runes[:i+1])
+		case !isIdent(runes[i]) || i == 1 && runes[i] >= '0' && runes[i] <= '9':
+			// $1 is a parameter.
+			return ""
+		}
+	}
+	return ""
+}
+
+func isIdent(ch rune) bool {
+	return ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch > 127
+}
@@ -0,0 +1,153 @@
+package migrate_test
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/lysu/go-misc/ds/migrate"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestNew(t *testing.T) {
+	fsys := fstest.MapFS{
+		"sql/0002_add_email.up.sql":   {Data: []byte("ALTER TABLE users ADD email TEXT")},
+		"sql/0002_add_email.down.sql": {Data: []byte("ALTER TABLE users DROP email")},
+		"sql/0001_users.up.sql":       {Data: []byte("CREATE TABLE users (id INT)")},
+		"sql/README.md":               {Data: []byte("ignored")},
+	}
+	r, err := migrate.New("default", migrate.SQLite, fsys, "sql")
+	assert.NoError(t, err)
+	migrations := r.Migrations()
+	assert.Len(t, migrations, 2)
+	assert.Equal(t, int64(1), migrations[0].Version)
+	assert.Equal(t, "users", migrations[0].Name)
+	assert.Equal(t, "", migrations[0].Down)
+	assert.Equal(t, "add_email", migrations[1].Name)
+
+	_, err = migrate.New("default", migrate.SQLite, fstest.MapFS{
+		"sql/0001_users.down.sql": {Data: []byte("DROP TABLE users")},
+	}, "sql")
+	assert.Error(t, err)
+}
+
+func TestSplitStatements(t *testing.T) {
+	stmts := migrate.SplitStatements(`
+-- create; the table
+CREATE TABLE t (a TEXT DEFAULT ';');
+INSERT INTO t VALUES ('x;y'); -- trailing
+`)
+	assert.Equal(t, []string{
+		"CREATE TABLE t (a TEXT DEFAULT ';')",
+		"INSERT INTO t VALUES ('x;y')",
+	}, stmts)
+}
+
+func TestSplitStatementsBodies(t *testing.T) {
+	stmts := migrate.SplitStatements(`
+CREATE FUNCTION f() RETURNS trigger AS $$
+BEGIN
+	NEW.a := 'x;y';
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+CREATE FUNCTION g() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql;
+SELECT $1, a$b FROM t;
+/* one; two */ INSERT INTO t VALUES ('it\'s; fine', "q\";");
+SELECT 1 /*+ hint */;
+SELECT ` + "`a;b`" + `;
+`)
+	assert.Equal(t, []string{
+		"CREATE FUNCTION f() RETURNS trigger AS $$\nBEGIN\n\tNEW.a := 'x;y';\n\tRETURN NEW;\nEND;\n$$ LANGUAGE plpgsql",
+		"CREATE FUNCTION g() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql",
+		"SELECT $1, a$b FROM t",
+		`/* one; two */ INSERT INTO t VALUES ('it\'s; fine', "q\";")`,
+		"SELECT 1 /*+ hint */",
+		"SELECT `a;b`",
+	}, stmts)
+	assert.Equal(t, []string{"SELECT 1", "/* open;"}, migrate.SplitStatements("SELECT 1; /* open;"))
+}
+
+func TestRunner(t *testing.T) {
+	dstest.SQLite(t)
+	fsys := fstest.MapFS{
+		"sql/0001_users.up.sql":       {Data: []byte("CREATE TABLE users (id INT); INSERT INTO users VALUES (1);")},
+		"sql/0001_users.down.sql":     {Data: []byte("DROP TABLE users")},
+		"sql/0002_add_email.up.sql":   {Data: []byte("ALTER TABLE users ADD email TEXT")},
+		"sql/0002_add_email.down.sql": {Data: []byte("ALTER TABLE users DROP email")},
+	}
+	r, err := migrate.New(ds.DEFAULT_DATASOURCE, migrate.SQLite, fsys, "sql")
+	assert.NoError(t, err)
+	c := context.Background()
+	applied := func() []bool {
+		status, err := r.Status(c)
+		assert.NoError(t, err)
+		var applied []bool
+		for _, st := range status {
+			applied = append(applied, st.Applied)
+		}
+		return applied
+	}
+	versions := func(ms []*migrate.Migration) []int64 {
+		var versions []int64
+		for _, m := range ms {
+			versions = append(versions, m.Version)
+		}
+		return versions
+	}
+
+	assert.Equal(t, []bool{false, false}, applied(), "Status works before the table exists")
+
+	var out bytes.Buffer
+	r.DryRun, r.Out = true, &out
+	done, err := r.Up(c)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2}, versions(done))
+	assert.Contains(t, out.String(), "-- 1_users (up)")
+	assert.Contains(t, out.String(), "ALTER TABLE users ADD email TEXT")
+	r.DryRun = false
+	assert.Equal(t, []bool{false, false}, applied(), "dry runs change nothing")
+
+	done, err = r.Up(c)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2}, versions(done))
+	assert.Equal(t, []bool{true, true}, applied())
+	n, err := ds.Get[int](c, "SELECT COUNT(email) + COUNT(*) FROM users")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	done, err = r.Up(c)
+	assert.NoError(t, err)
+	assert.Empty(t, done)
+
+	done, err = r.Down(c, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2}, versions(done))
+	assert.Equal(t, []bool{true, false}, applied())
+	_, err = ds.Exec(c, "SELECT email FROM users")
+	assert.Error(t, err)
+
+	done, err = r.Down(c, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1}, versions(done))
+	assert.Equal(t, []bool{false, false}, applied())
+}
+
+func TestRunnerFailedMigration(t *testing.T) {
+	dstest.SQLite(t)
+	r, err := migrate.New(ds.DEFAULT_DATASOURCE, migrate.SQLite, fstest.MapFS{
+		"sql/0001_users.up.sql": {Data: []byte("CREATE TABLE users (id INT); INSERT INTO nope VALUES (1)")},
+	}, "sql")
+	assert.NoError(t, err)
+	c := context.Background()
+	_, err = r.Up(c)
+	assert.Error(t, err)
+	status, err := r.Status(c)
+	assert.NoError(t, err)
+	assert.False(t, status[0].Applied)
+	_, err = ds.Exec(c, "SELECT id FROM users")
+	assert.Error(t, err, "transactional DDL rolled back")
+}
@@ -0,0 +1,174 @@
+package ds
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+const DS_MULTI_KEY = "_multi_"
+
+// Compensations receives the entries of partially committed DoMultiTx
+// calls. Entries are still returned in *PartialCommitError when it is nil.
+var Compensations CompensationLog
+
+type multiTx struct {
+	txs     map[string]*boundTx
+	mu      sync.Mutex
+	actions []CompensationAction
+}
+
+type PartialCommitError struct {
+	Entry *CompensationEntry
+	Err   error
+	// LogErr is set when the entry could not be appended to Compensations.
+	LogErr error
+}
+
+func (e *PartialCommitError) Error() string {
+	msg := fmt.Sprintf("Partial commit %s: committed %v, failed %v: %v", e.Entry.ID, e.Entry.Committed, e.Entry.Failed, e.Err)
+	if e.LogErr != nil {
+		msg += fmt.Sprintf(" (not logged: %v)", e.LogErr)
+	}
+	return msg
+}
+
+func (e *PartialCommitError) Unwrap() error {
+	return e.Err
+}
+
+// DoMultiTx opens a transaction on each of names and commits them in that
+// order once f succeeds. This is best effort: when a commit fails after
+// earlier ones succeeded, the gap is appended to Compensations along with
+// the actions f registered with Compensate, and *PartialCommitError is
+// returned.
+func DoMultiTx(c context.Context, names []string, f func(c context.Context) (interface{}, error), noRollbackErrs ...error) (v interface{}, err error) {
+	if len(names) == 0 {
+		return nil, errors.New("DoMultiTx without any data source")
+	}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if seen[name] {
+			return nil, errors.Errorf("Data source %s given to DoMultiTx twice", name)
+		}
+		seen[name] = true
+	}
+	m := &multiTx{txs: map[string]*boundTx{}}
+	for _, name := range names {
+		db, err := DataSource(name)
+		if err != nil {
+			m.rollback(names)
+			return nil, err
+		}
+		tx, err := db.Beginx()
+		if err != nil {
+			m.rollback(names)
+			return nil, errors.Trace(err)
+		}
+		m.txs[name] = &boundTx{ds: name, tx: tx}
+	}
+	c = context.WithValue(c, DS_MULTI_KEY, m)
+	c = Using(c, names[0])
+	v, err = f(c)
+	if err != nil && isRollbackErr(err, noRollbackErrs) {
+		m.rollback(names)
+		return
+	}
+	err = keptErr(err)
+	for i, name := range names {
+		err2 := m.txs[name].tx.Commit()
+		Instrument.endTx(name, true, err2)
+		m.txs[name].runHooks(0, err2 == nil)
+		if err2 == nil {
+			continue
+		}
+		m.rollback(names[i+1:])
+		if i == 0 {
+			return v, errors.Trace(err2)
+		}
+		return v, m.partial(names[:i], names[i:], err2)
+	}
+	return
+}
+
+// Using binds the DoMultiTx transaction of name as the executor of c, so
+// Executor, Get, Select and Exec run on it.
+func Using(c context.Context, name string) context.Context {
+	m, ok := c.Value(DS_MULTI_KEY).(*multiTx)
+	if !ok {
+		return c
+	}
+	bt, ok := m.txs[name]
+	if !ok {
+		return c
+	}
+	c = context.WithValue(c, DATASOURCE_KEY, name)
+	c = context.WithValue(c, DS_TX_KEY, bt)
+	return bindExecutor(c, name, bt.tx)
+}
+
+// ExecutorOf returns the DoMultiTx transaction of name.
+func ExecutorOf(c context.Context, name string) (IExecutor, error) {
+	m, ok := c.Value(DS_MULTI_KEY).(*multiTx)
+	if !ok {
+		return nil, errors.New("Context without any multi data source transaction")
+	}
+	if _, ok = m.txs[name]; !ok {
+		return nil, errors.Errorf("Data source %s is not part of the transaction", name)
+	}
+	return Executor(Using(c, name))
+}
+
+// Compensate records what to do about ds if the transaction ends up
+// partially committed; payload is stored as JSON for replay handlers.
+func Compensate(c context.Context, ds, action string, payload interface{}) error {
+	m, ok := c.Value(DS_MULTI_KEY).(*multiTx)
+	if !ok {
+		return errors.New("Compensate must be called inside DoMultiTx")
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	m.mu.Lock()
+	m.actions = append(m.actions, CompensationAction{DataSource: ds, Action: action, Payload: b})
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *multiTx) rollback(names []string) {
+	for _, name := range names {
+		if bt, ok := m.txs[name]; ok {
+			Instrument.endTx(name, false, bt.tx.Rollback())
+			bt.runHooks(0, false)
+		}
+	}
+}
+
+func (m *multiTx) partial(committed, failed []string, cause error) error {
+	entry := &CompensationEntry{
+		ID:        newEntryID(),
+		Time:      time.Now(),
+		Committed: committed,
+		Failed:    failed,
+		Err:       cause.Error(),
+		Actions:   m.actions,
+	}
+	err := &PartialCommitError{Entry: entry, Err: cause}
+	if Compensations != nil {
+		err.LogErr = Compensations.Append(entry)
+	}
+	return err
+}
+
+func newEntryID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,139 @@
+package ds_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func openMulti(t *testing.T) {
+	orders := dstest.SQLite(t)
+	orders.MustExec("CREATE TABLE orders (id INTEGER PRIMARY KEY)")
+
+	stock, err := sqlx.Connect("sqlite", ":memory:")
+	assert.NoError(t, err)
+	stock.SetMaxOpenConns(1)
+	stock.MustExec("PRAGMA foreign_keys = ON")
+	stock.MustExec("CREATE TABLE items (id INTEGER PRIMARY KEY)")
+	// The deferred foreign key makes COMMIT itself fail.
+	stock.MustExec(`CREATE TABLE reservations (item_id INTEGER
+		REFERENCES items(id) DEFERRABLE INITIALLY DEFERRED)`)
+	ds.RegisterDataSource("stock", stock)
+	t.Cleanup(func() {
+		delete(ds.DataSources, "stock")
+		stock.Close()
+	})
+}
+
+func TestDoMultiTx(t *testing.T) {
+	openMulti(t)
+	c := context.Background()
+	names := []string{ds.DEFAULT_DATASOURCE, "stock"}
+
+	_, err := ds.DoMultiTx(c, names, func(c context.Context) (interface{}, error) {
+		if _, err := ds.Exec(c, "INSERT INTO orders VALUES (1)"); err != nil {
+			return nil, err
+		}
+		_, err := ds.Exec(ds.Using(c, "stock"), "INSERT INTO items VALUES (1)")
+		return nil, err
+	})
+	assert.NoError(t, err)
+
+	_, err = ds.DoMultiTx(c, names, func(c context.Context) (interface{}, error) {
+		ds.Exec(c, "INSERT INTO orders VALUES (2)")
+		return nil, errors.New("rollback")
+	})
+	assert.Error(t, err)
+
+	orders, _ := ds.Select[int64](c, "SELECT id FROM orders")
+	assert.Equal(t, []int64{1}, orders)
+	items, _ := ds.Select[int64](ds.WithDataSource(c, "stock"), "SELECT id FROM items")
+	assert.Equal(t, []int64{1}, items)
+}
+
+func TestDoMultiTxDuplicate(t *testing.T) {
+	openMulti(t)
+	called := false
+	_, err := ds.DoMultiTx(context.Background(), []string{"stock", ds.DEFAULT_DATASOURCE, "stock"}, func(c context.Context) (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	assert.Error(t, err)
+	assert.False(t, called)
+	// Nothing was left open on the single connection.
+	_, err = ds.Exec(ds.WithDataSource(context.Background(), "stock"), "INSERT INTO items VALUES (9)")
+	assert.NoError(t, err)
+}
+
+func TestDoMultiTxPartialCommit(t *testing.T) {
+	openMulti(t)
+	log := ds.NewFileCompensationLog(filepath.Join(t.TempDir(), "compensation.log"))
+	ds.Compensations = log
+	defer func() { ds.Compensations = nil }()
+	c := context.Background()
+
+	_, err := ds.DoMultiTx(c, []string{ds.DEFAULT_DATASOURCE, "stock"}, func(c context.Context) (interface{}, error) {
+		if _, err := ds.Exec(c, "INSERT INTO orders VALUES (7)"); err != nil {
+			return nil, err
+		}
+		exe, err := ds.ExecutorOf(c, "stock")
+		if err != nil {
+			return nil, err
+		}
+		if _, err = exe.Exec("INSERT INTO reservations VALUES (42)"); err != nil {
+			return nil, err
+		}
+		return nil, ds.Compensate(c, ds.DEFAULT_DATASOURCE, "cancel-order", 7)
+	})
+	partial, ok := errors.Cause(err).(*ds.PartialCommitError)
+	if !assert.True(t, ok, "%v", err) {
+		return
+	}
+	assert.Equal(t, []string{ds.DEFAULT_DATASOURCE}, partial.Entry.Committed)
+	assert.Equal(t, []string{"stock"}, partial.Entry.Failed)
+
+	pending, err := log.Pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	n, err := ds.ReplayCompensations(c, log, map[string]ds.CompensationHandler{
+		"cancel-order": func(c context.Context, entry *ds.CompensationEntry, action ds.CompensationAction) error {
+			_, err := ds.Exec(c, "DELETE FROM orders WHERE id = ?", string(action.Payload))
+			return err
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	pending, _ = log.Pending()
+	assert.Empty(t, pending)
+	orders, _ := ds.Select[int64](c, "SELECT id FROM orders")
+	assert.Empty(t, orders)
+}
+
+func TestFileCompensationLogTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "compensation.log")
+	log := ds.NewFileCompensationLog(path)
+	assert.NoError(t, log.Append(&ds.CompensationEntry{ID: "a"}))
+	// A crash tore the write of the next entry.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.WriteString(`{"id":"torn","ti`)
+	f.Close()
+	assert.NoError(t, log.Append(&ds.CompensationEntry{ID: "b"}))
+	assert.NoError(t, log.Append(&ds.CompensationEntry{ID: "c"}))
+
+	pending, err := log.Pending()
+	assert.NoError(t, err)
+	var ids []string
+	for _, entry := range pending {
+		ids = append(ids, entry.ID)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, ids)
+}
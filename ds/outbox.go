@@ -0,0 +1,224 @@
+package ds
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	OUTBOX_PENDING = 0
+	OUTBOX_SENT    = 1
+	OUTBOX_FAILED  = 2
+	// OUTBOX_HELD messages wait for whoever wrote them to set them to
+	// OUTBOX_PENDING or delete them; the Relay leaves them alone.
+	OUTBOX_HELD = 3
+)
+
+var OutboxTable = "ds_outbox"
+
+// OutboxSchema returns the MySQL statement creating OutboxTable.
+func OutboxSchema() string {
+	return "CREATE TABLE " + OutboxTable + ` (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	topic VARCHAR(255) NOT NULL,
+	msg_key VARCHAR(255) NOT NULL DEFAULT '',
+	payload BLOB NOT NULL,
+	status TINYINT NOT NULL DEFAULT 0,
+	attempts INT NOT NULL DEFAULT 0,
+	last_error VARCHAR(1024) NOT NULL DEFAULT '',
+	next_attempt_at DATETIME NOT NULL,
+	created_at DATETIME NOT NULL,
+	sent_at DATETIME NULL,
+	KEY idx_status_id (status, id),
+	KEY idx_key_status (msg_key, status)
+)`
+}
+
+type OutboxMessage struct {
+	ID            int64     `db:"id"`
+	Topic         string    `db:"topic"`
+	Key           string    `db:"msg_key"`
+	Payload       []byte    `db:"payload"`
+	Attempts      int       `db:"attempts"`
+	NextAttemptAt time.Time `db:"next_attempt_at"`
+	CreatedAt     time.Time `db:"created_at"`
+}
+
+// Outbox stores payload in the outbox table as part of the caller's DoTx,
+// so the message is relayed only if the transaction commits.
+func Outbox(c context.Context, topic string, payload []byte) error {
+	return OutboxWithKey(c, topic, "", payload)
+}
+
+// OutboxWithKey is Outbox with an aggregate key; messages sharing a key
+// are published in insertion order.
+func OutboxWithKey(c context.Context, topic, key string, payload []byte) error {
+	if !inTx(c) {
+		return errors.New("Outbox must be called inside DoTx")
+	}
+	exe, err := Executor(c)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err = exe.Exec(exe.Rebind("INSERT INTO "+OutboxTable+
+		" (topic, msg_key, payload, status, attempts, next_attempt_at, created_at) VALUES (?, ?, ?, ?, 0, ?, ?)"),
+		topic, key, payload, OUTBOX_PENDING, now, now)
+	return errors.Trace(err)
+}
+
+type Publisher interface {
+	Publish(c context.Context, msg *OutboxMessage) error
+}
+
+type PublisherFunc func(c context.Context, msg *OutboxMessage) error
+
+func (f PublisherFunc) Publish(c context.Context, msg *OutboxMessage) error {
+	return f(c, msg)
+}
+
+// Relay polls the outbox of one data source and publishes pending
+// messages. Run a single Relay per data source.
+type Relay struct {
+	DataSource  string
+	Publisher   Publisher
+	BatchSize   int
+	Interval    time.Duration
+	MaxAttempts int
+	Backoff     func(attempts int) time.Duration
+	// Logger gets the errors Run keeps going after.
+	Logger *slog.Logger
+	Now    func() time.Time
+}
+
+func NewRelay(ds string, publisher Publisher) *Relay {
+	return &Relay{
+		DataSource:  ds,
+		Publisher:   publisher,
+		BatchSize:   100,
+		Interval:    time.Second,
+		MaxAttempts: 10,
+		Backoff:     ExponentialBackoff(time.Second, 5*time.Minute),
+		Logger:      slog.Default(),
+		Now:         time.Now,
+	}
+}
+
+func ExponentialBackoff(base, max time.Duration) func(attempts int) time.Duration {
+	return func(attempts int) time.Duration {
+		d := base
+		for i := 1; i < attempts && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// Run relays until c is done. A full batch is followed by the next one
+// right away; errors are logged and retried after Backoff.
+func (r *Relay) Run(c context.Context) error {
+	failures := 0
+	for {
+		n, err := r.RelayOnce(c)
+		wait := r.Interval
+		switch {
+		case err != nil:
+			if c.Err() != nil {
+				return c.Err()
+			}
+			failures++
+			wait = r.Backoff(failures)
+			if r.Logger != nil {
+				r.Logger.Warn("ds: relay outbox", "ds", r.DataSource, "failures", failures, "err", err)
+			}
+		case n == r.BatchSize:
+			failures = 0
+			wait = 0
+		default:
+			failures = 0
+		}
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// RelayOnce publishes one batch and returns how many messages it
+// published. A message waiting for a retry, or given up on as
+// OUTBOX_FAILED, holds back later messages with its key; those stay
+// pending until the failed one is deleted or set back to OUTBOX_PENDING.
+func (r *Relay) RelayOnce(c context.Context) (int, error) {
+	v, err := DoNoTx(WithDataSource(c, r.DataSource), func(c context.Context) (interface{}, error) {
+		exe, err := Executor(c)
+		if err != nil {
+			return 0, err
+		}
+		now := r.now()
+		// Held back keys are skipped in the query, so they cannot fill
+		// every batch and starve the rest.
+		var msgs []*OutboxMessage
+		err = sqlx.Select(exe, &msgs, exe.Rebind("SELECT id, topic, msg_key, payload, attempts, next_attempt_at, created_at FROM "+
+			OutboxTable+" WHERE status = ? AND next_attempt_at <= ? AND msg_key NOT IN (SELECT msg_key FROM "+OutboxTable+
+			" WHERE msg_key <> '' AND (status = ? OR (status = ? AND next_attempt_at > ?))) ORDER BY id LIMIT ?"),
+			OUTBOX_PENDING, now, OUTBOX_FAILED, OUTBOX_PENDING, now, r.BatchSize)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		blocked := map[string]bool{}
+		sent := 0
+		for _, msg := range msgs {
+			if msg.Key != "" && blocked[msg.Key] {
+				continue
+			}
+			if c.Err() != nil {
+				return sent, c.Err()
+			}
+			pubErr := r.Publisher.Publish(c, msg)
+			if pubErr == nil {
+				_, err = exe.Exec(exe.Rebind("UPDATE "+OutboxTable+" SET status = ?, sent_at = ? WHERE id = ?"),
+					OUTBOX_SENT, r.now(), msg.ID)
+				sent++
+			} else {
+				blocked[msg.Key] = true
+				err = r.fail(exe, msg, pubErr)
+			}
+			if err != nil {
+				return sent, errors.Trace(err)
+			}
+		}
+		return sent, nil
+	})
+	n, _ := v.(int)
+	return n, err
+}
+
+func (r *Relay) now() time.Time {
+	if r.Now == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
+
+func (r *Relay) fail(exe IExecutor, msg *OutboxMessage, pubErr error) error {
+	attempts := msg.Attempts + 1
+	status := OUTBOX_PENDING
+	if r.MaxAttempts > 0 && attempts >= r.MaxAttempts {
+		status = OUTBOX_FAILED
+	}
+	lastErr := pubErr.Error()
+	if len(lastErr) > 1024 {
+		lastErr = lastErr[:1024]
+	}
+	_, err := exe.Exec(exe.Rebind("UPDATE "+OutboxTable+" SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?"),
+		status, attempts, lastErr, r.now().Add(r.Backoff(attempts)), msg.ID)
+	return err
+}
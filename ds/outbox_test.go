@@ -0,0 +1,191 @@
+package ds_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// recorder publishes every payload that is not set to fail.
+type recorder struct {
+	fail map[string]bool
+	sent []string
+}
+
+func (r *recorder) Publish(c context.Context, msg *ds.OutboxMessage) error {
+	if r.fail[string(msg.Payload)] {
+		return errors.New("broker down")
+	}
+	r.sent = append(r.sent, string(msg.Payload))
+	return nil
+}
+
+// take returns what was published since the last call.
+func (r *recorder) take() []string {
+	sent := r.sent
+	r.sent = nil
+	return sent
+}
+
+func setupOutbox(t *testing.T) {
+	dstest.CreateOutbox(t, dstest.SQLite(t))
+}
+
+func addOutbox(t *testing.T, key string, payloads ...string) {
+	_, err := ds.DoTx(context.Background(), func(c context.Context) (interface{}, error) {
+		for _, p := range payloads {
+			if err := ds.OutboxWithKey(c, "events", key, []byte(p)); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	assert.NoError(t, err)
+}
+
+func outboxStatus(t *testing.T, payload string) int {
+	status, err := ds.Get[int](context.Background(), "SELECT status FROM ds_outbox WHERE payload = ?", []byte(payload))
+	assert.NoError(t, err)
+	return status
+}
+
+func relayOnce(t *testing.T, relay *ds.Relay, n int) {
+	sent, err := relay.RelayOnce(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, n, sent)
+}
+
+func TestOutboxRequiresTx(t *testing.T) {
+	setupOutbox(t)
+	assert.Error(t, ds.Outbox(context.Background(), "events", []byte("x")))
+}
+
+func TestRelayOnceOrder(t *testing.T) {
+	setupOutbox(t)
+	addOutbox(t, "a", "a1", "a2")
+	addOutbox(t, "", "x1")
+	addOutbox(t, "b", "b1")
+	addOutbox(t, "a", "a3")
+	rec := &recorder{}
+	relay := ds.NewRelay(ds.DEFAULT_DATASOURCE, rec)
+
+	relayOnce(t, relay, 5)
+	assert.Equal(t, []string{"a1", "a2", "x1", "b1", "a3"}, rec.take())
+	assert.Equal(t, ds.OUTBOX_SENT, outboxStatus(t, "a3"))
+	relayOnce(t, relay, 0)
+}
+
+func TestRelayOnceBackoff(t *testing.T) {
+	setupOutbox(t)
+	addOutbox(t, "a", "a1", "a2")
+	addOutbox(t, "b", "b1")
+	rec := &recorder{fail: map[string]bool{"a1": true}}
+	relay := ds.NewRelay(ds.DEFAULT_DATASOURCE, rec)
+	relay.Backoff = func(attempts int) time.Duration { return time.Minute }
+	// Past the real time the messages were stamped with.
+	now := time.Now().Add(time.Second)
+	relay.Now = func() time.Time { return now }
+
+	relayOnce(t, relay, 1)
+	assert.Equal(t, []string{"b1"}, rec.take(), "a2 waits behind a1")
+	assert.Equal(t, ds.OUTBOX_PENDING, outboxStatus(t, "a1"))
+
+	rec.fail["a1"] = false
+	now = now.Add(30 * time.Second)
+	relayOnce(t, relay, 0)
+	now = now.Add(time.Minute)
+	relayOnce(t, relay, 2)
+	assert.Equal(t, []string{"a1", "a2"}, rec.take())
+}
+
+func TestRelayOnceFailed(t *testing.T) {
+	setupOutbox(t)
+	addOutbox(t, "a", "a1", "a2")
+	rec := &recorder{fail: map[string]bool{"a1": true}}
+	relay := ds.NewRelay(ds.DEFAULT_DATASOURCE, rec)
+	relay.MaxAttempts = 2
+	relay.Backoff = func(attempts int) time.Duration { return 0 }
+
+	relayOnce(t, relay, 0)
+	relayOnce(t, relay, 0)
+	assert.Equal(t, ds.OUTBOX_FAILED, outboxStatus(t, "a1"))
+	relayOnce(t, relay, 0)
+	assert.Equal(t, ds.OUTBOX_PENDING, outboxStatus(t, "a2"), "a2 stays behind the failed a1")
+
+	_, err := ds.Exec(context.Background(), "UPDATE ds_outbox SET status = ? WHERE payload = ?", ds.OUTBOX_PENDING, []byte("a1"))
+	assert.NoError(t, err)
+	rec.fail["a1"] = false
+	relayOnce(t, relay, 2)
+	assert.Equal(t, []string{"a1", "a2"}, rec.take())
+}
+
+func TestRelayOnceStarvation(t *testing.T) {
+	setupOutbox(t)
+	addOutbox(t, "a", "a1", "a2", "a3")
+	addOutbox(t, "b", "b1")
+	rec := &recorder{fail: map[string]bool{"a1": true}}
+	relay := ds.NewRelay(ds.DEFAULT_DATASOURCE, rec)
+	relay.BatchSize = 2
+
+	relayOnce(t, relay, 0)
+	relayOnce(t, relay, 1)
+	assert.Equal(t, []string{"b1"}, rec.take(), "held a rows do not fill the batch")
+}
+
+func TestRelayRun(t *testing.T) {
+	setupOutbox(t)
+	addOutbox(t, "", "x1", "x2", "x3")
+	published := make(chan string, 3)
+	relay := ds.NewRelay(ds.DEFAULT_DATASOURCE, ds.PublisherFunc(func(c context.Context, msg *ds.OutboxMessage) error {
+		published <- string(msg.Payload)
+		return nil
+	}))
+	relay.BatchSize = 1
+	relay.Interval = time.Hour
+	c, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- relay.Run(c) }()
+	for _, want := range []string{"x1", "x2", "x3"} {
+		select {
+		case got := <-published:
+			assert.Equal(t, want, got, "full batches follow right away")
+		case <-time.After(time.Second):
+			t.Fatal("relay stalled")
+		}
+	}
+	cancel()
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("Run ignores cancel")
+	}
+}
+
+func TestRelayRunKeepsGoing(t *testing.T) {
+	// No outbox table, so every batch fails.
+	dstest.SQLite(t)
+	relay := ds.NewRelay(ds.DEFAULT_DATASOURCE, &recorder{})
+	relay.Logger = nil
+	failures := 0
+	relay.Backoff = func(attempts int) time.Duration {
+		failures = attempts
+		return time.Millisecond
+	}
+	c, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, relay.Run(c))
+	assert.True(t, failures > 1, "Run retries after errors")
+}
+
+func TestOutboxSchema(t *testing.T) {
+	defer func(table string) { ds.OutboxTable = table }(ds.OutboxTable)
+	ds.OutboxTable = "app_outbox"
+	assert.True(t, strings.HasPrefix(ds.OutboxSchema(), "CREATE TABLE app_outbox ("))
+}
@@ -0,0 +1,297 @@
+package page
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"golang.org/x/net/context"
+)
+
+var ErrBadCursor = errors.New("Bad cursor")
+
+// Signer seals cursors so clients can pass them back but not forge them.
+type Signer struct {
+	Key []byte
+}
+
+var errNoSigner = errors.New("Cursor without any signer")
+
+// cursorKey is one value of a cursor, tagged with its type so it comes back
+// as what went in.
+type cursorKey struct {
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v"`
+}
+
+func (s *Signer) Encode(values []interface{}) (string, error) {
+	if s == nil {
+		return "", errNoSigner
+	}
+	keys := make([]cursorKey, len(values))
+	for i, v := range values {
+		key, err := newCursorKey(v)
+		if err != nil {
+			return "", err
+		}
+		keys[i] = key
+	}
+	payload, err := json.Marshal(keys)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (s *Signer) Decode(cursor string) ([]interface{}, error) {
+	if s == nil {
+		return nil, errNoSigner
+	}
+	i := strings.IndexByte(cursor, '.')
+	if i < 0 {
+		return nil, ErrBadCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(cursor[:i])
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(cursor[i+1:])
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return nil, ErrBadCursor
+	}
+	var keys []cursorKey
+	if err = json.Unmarshal(payload, &keys); err != nil {
+		return nil, ErrBadCursor
+	}
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if values[i], err = key.value(); err != nil {
+			return nil, ErrBadCursor
+		}
+	}
+	return values, nil
+}
+
+func newCursorKey(v interface{}) (cursorKey, error) {
+	var typ string
+	switch k := v.(type) {
+	case nil:
+		typ = "null"
+	case bool:
+		typ = "bool"
+	case int:
+		typ, v = "int", int64(k)
+	case int8:
+		typ, v = "int", int64(k)
+	case int16:
+		typ, v = "int", int64(k)
+	case int32:
+		typ, v = "int", int64(k)
+	case int64:
+		typ = "int"
+	case uint:
+		typ, v = "uint", uint64(k)
+	case uint8:
+		typ, v = "uint", uint64(k)
+	case uint16:
+		typ, v = "uint", uint64(k)
+	case uint32:
+		typ, v = "uint", uint64(k)
+	case uint64:
+		typ = "uint"
+	case float32:
+		typ, v = "float", float64(k)
+	case float64:
+		typ = "float"
+	case string:
+		typ = "string"
+	case []byte:
+		typ = "bytes"
+	case time.Time:
+		typ = "time"
+	default:
+		return cursorKey{}, errors.Errorf("Unsupported cursor key type %T", v)
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return cursorKey{}, errors.Trace(err)
+	}
+	return cursorKey{Type: typ, Value: raw}, nil
+}
+
+func (key cursorKey) value() (interface{}, error) {
+	var err error
+	switch key.Type {
+	case "null":
+		return nil, nil
+	case "bool":
+		var v bool
+		err = json.Unmarshal(key.Value, &v)
+		return v, err
+	case "int":
+		var v int64
+		err = json.Unmarshal(key.Value, &v)
+		return v, err
+	case "uint":
+		var v uint64
+		err = json.Unmarshal(key.Value, &v)
+		return v, err
+	case "float":
+		var v float64
+		err = json.Unmarshal(key.Value, &v)
+		return v, err
+	case "string":
+		var v string
+		err = json.Unmarshal(key.Value, &v)
+		return v, err
+	case "bytes":
+		var v []byte
+		err = json.Unmarshal(key.Value, &v)
+		return v, err
+	case "time":
+		var v time.Time
+		err = json.Unmarshal(key.Value, &v)
+		return v, err
+	}
+	return nil, errors.Errorf("Unknown cursor key type %s", key.Type)
+}
+
+// Keyset pages a query by the columns in OrderBy, which together must be
+// unique, e.g. {"created_at", "id"}. Query is a SELECT without ORDER BY
+// or LIMIT; Where, if set, is ANDed with the cursor condition.
+type Keyset[T any] struct {
+	Query   string
+	Where   string
+	OrderBy []string
+	Desc    bool
+	// Key returns the OrderBy values of a row for the next cursor.
+	Key    func(row T) []interface{}
+	Signer *Signer
+}
+
+type Page[T any] struct {
+	Items []T
+	// Next is empty on the last page.
+	Next  string
+	Total int64
+}
+
+func (k *Keyset[T]) Fetch(c context.Context, cursor string, limit int, args ...interface{}) (*Page[T], error) {
+	if limit <= 0 {
+		return nil, errors.Errorf("Bad page limit %d", limit)
+	}
+	if k.Signer == nil {
+		return nil, errNoSigner
+	}
+	if k.Key == nil {
+		return nil, errors.New("Keyset without Key")
+	}
+	// The cursor and limit go on a copy, not into the caller's array.
+	args = append([]interface{}(nil), args...)
+	var conds []string
+	if k.Where != "" {
+		conds = append(conds, "("+k.Where+")")
+	}
+	if cursor != "" {
+		after, err := k.Signer.Decode(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if len(after) != len(k.OrderBy) {
+			return nil, ErrBadCursor
+		}
+		cmp := ">"
+		if k.Desc {
+			cmp = "<"
+		}
+		conds = append(conds, "("+strings.Join(k.OrderBy, ", ")+") "+cmp+" ("+ds.Placeholders(len(after))+")")
+		args = append(args, after...)
+	}
+	query := k.Query
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	order := strings.Join(k.OrderBy, ", ")
+	if k.Desc {
+		order = strings.Join(k.OrderBy, " DESC, ") + " DESC"
+	}
+	query += " ORDER BY " + order + " LIMIT ?"
+	args = append(args, limit+1)
+	items, err := ds.Select[T](c, ds.Rebind(c, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	page := &Page[T]{Items: items}
+	if len(items) > limit {
+		page.Items = items[:limit]
+		if page.Next, err = k.Signer.Encode(k.Key(items[limit-1])); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// Offset pages with LIMIT/OFFSET. Query is a complete SELECT without
+// LIMIT; CountQuery, when set, fills Page.Total.
+type Offset[T any] struct {
+	Query      string
+	CountQuery string
+}
+
+func (o *Offset[T]) Fetch(c context.Context, offset, limit int, args ...interface{}) (*Page[T], error) {
+	if limit <= 0 {
+		return nil, errors.Errorf("Bad page limit %d", limit)
+	}
+	if offset < 0 {
+		return nil, errors.Errorf("Bad page offset %d", offset)
+	}
+	pageArgs := append(append([]interface{}(nil), args...), limit, offset)
+	items, err := ds.Select[T](c, ds.Rebind(c, o.Query+" LIMIT ? OFFSET ?"), pageArgs...)
+	if err != nil {
+		return nil, err
+	}
+	page := &Page[T]{Items: items}
+	if o.CountQuery != "" {
+		if page.Total, err = ds.Get[int64](c, ds.Rebind(c, o.CountQuery), args...); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// Stream walks every row of k in batches of size, each in its own DoNoTx,
+// so no transaction or cursor is held open between batches. It stops at
+// the first error from f.
+func Stream[T any](c context.Context, k *Keyset[T], size int, f func(batch []T) error, args ...interface{}) error {
+	cursor := ""
+	for {
+		page, err := ds.NoTx(c, func(c context.Context) (*Page[T], error) {
+			return k.Fetch(c, cursor, size, args...)
+		})
+		if err != nil {
+			return err
+		}
+		if len(page.Items) > 0 {
+			if err = f(page.Items); err != nil {
+				return err
+			}
+		}
+		if page.Next == "" {
+			return nil
+		}
+		cursor = page.Next
+	}
+}
@@ -0,0 +1,159 @@
+package page_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/lysu/go-misc/ds/page"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type item struct {
+	ID   int64  `db:"id"`
+	Name string `db:"name"`
+}
+
+func setup(t *testing.T) context.Context {
+	dstest.SQLite(t)
+	c := dstest.Begin(t)
+	_, err := ds.Exec(c, "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)")
+	assert.NoError(t, err)
+	for i := 1; i <= 25; i++ {
+		_, err = ds.Exec(c, "INSERT INTO items VALUES (?, ?)", i, fmt.Sprintf("item-%d", i))
+		assert.NoError(t, err)
+	}
+	return c
+}
+
+func keyset() *page.Keyset[item] {
+	return &page.Keyset[item]{
+		Query:   "SELECT id, name FROM items",
+		Where:   "id <> ?",
+		OrderBy: []string{"id"},
+		Key:     func(row item) []interface{} { return []interface{}{row.ID} },
+		Signer:  &page.Signer{Key: []byte("secret")},
+	}
+}
+
+func TestKeyset(t *testing.T) {
+	c := setup(t)
+	k := keyset()
+
+	var ids []int64
+	cursor := ""
+	for pages := 0; ; pages++ {
+		p, err := k.Fetch(c, cursor, 10, 13)
+		assert.NoError(t, err)
+		for _, it := range p.Items {
+			ids = append(ids, it.ID)
+		}
+		if p.Next == "" {
+			assert.Equal(t, 2, pages)
+			break
+		}
+		cursor = p.Next
+	}
+	assert.Len(t, ids, 24)
+	assert.Equal(t, int64(25), ids[23])
+
+	k.Desc = true
+	p, err := k.Fetch(c, "", 3, 13)
+	assert.NoError(t, err)
+	assert.Equal(t, []item{{25, "item-25"}, {24, "item-24"}, {23, "item-23"}}, p.Items)
+}
+
+func TestBadCursor(t *testing.T) {
+	c := setup(t)
+	k := keyset()
+	p, err := k.Fetch(c, "", 10, 0)
+	assert.NoError(t, err)
+
+	forged, err := (&page.Signer{Key: []byte("guess")}).Encode([]interface{}{1})
+	assert.NoError(t, err)
+	for _, cursor := range []string{forged, p.Next[1:], "garbage"} {
+		_, err = k.Fetch(c, cursor, 10, 0)
+		assert.Equal(t, page.ErrBadCursor, err)
+	}
+}
+
+func TestBadFetch(t *testing.T) {
+	c := setup(t)
+	k := keyset()
+	_, err := k.Fetch(c, "", 0, 0)
+	assert.Error(t, err)
+	assert.Error(t, page.Stream(c, k, -1, func(batch []item) error { return nil }, 0))
+
+	k.Key = nil
+	_, err = k.Fetch(c, "", 1, 0)
+	assert.Error(t, err, "a nil Key is an error, not a panic")
+	k.Signer = nil
+	_, err = k.Fetch(c, "", 10, 0)
+	assert.Error(t, err)
+	o := &page.Offset[item]{Query: "SELECT id, name FROM items ORDER BY id"}
+	_, err = o.Fetch(c, 0, 0)
+	assert.Error(t, err)
+	_, err = o.Fetch(c, -1, 10)
+	assert.Error(t, err)
+	var s *page.Signer
+	_, err = s.Encode([]interface{}{1})
+	assert.Error(t, err)
+	_, err = s.Decode("x.y")
+	assert.Error(t, err)
+}
+
+func TestCursorTypes(t *testing.T) {
+	s := &page.Signer{Key: []byte("secret")}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 123, time.UTC)
+	values := []interface{}{int64(-7), uint64(1<<64 - 1), 1.5, "2024-05-01T12:00:00Z", at, []byte("b"), true, nil}
+	cursor, err := s.Encode(values)
+	assert.NoError(t, err)
+	decoded, err := s.Decode(cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, values, decoded, "strings that look like times stay strings")
+
+	cursor, err = s.Encode([]interface{}{7, int32(8), uint8(9)})
+	assert.NoError(t, err)
+	decoded, err = s.Decode(cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(7), int64(8), uint64(9)}, decoded)
+
+	_, err = s.Encode([]interface{}{struct{}{}})
+	assert.Error(t, err)
+}
+
+func TestOffset(t *testing.T) {
+	c := setup(t)
+	o := &page.Offset[item]{
+		Query:      "SELECT id, name FROM items WHERE id > ? ORDER BY id",
+		CountQuery: "SELECT COUNT(*) FROM items WHERE id > ?",
+	}
+	p, err := o.Fetch(c, 10, 5, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), p.Total)
+	assert.Equal(t, int64(16), p.Items[0].ID)
+	assert.Len(t, p.Items, 5)
+
+	// Fetch appends to a copy of args.
+	args := make([]interface{}, 1, 3)
+	args[0] = 10
+	_, err = o.Fetch(c, 0, 5, args...)
+	assert.NoError(t, err)
+	_, err = keyset().Fetch(c, "", 5, args...)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{10, nil, nil}, args[:3])
+}
+
+func TestStream(t *testing.T) {
+	c := setup(t)
+	var batches []int
+	err := page.Stream(c, keyset(), 10, func(batch []item) error {
+		batches = append(batches, len(batch))
+		return nil
+	}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{10, 10, 5}, batches)
+}
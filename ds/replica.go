@@ -0,0 +1,207 @@
+package ds
+
+import (
+	"database/sql"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+var Replicas = map[string]*ReplicaSet{}
+
+func RegisterReplicas(ds string, rs *ReplicaSet) {
+	registry.Lock()
+	defer registry.Unlock()
+	Replicas[ds] = rs
+}
+
+func replicaSet(ds string) *ReplicaSet {
+	registry.RLock()
+	defer registry.RUnlock()
+	return Replicas[ds]
+}
+
+// LagFunc reports how far a replica is behind its primary.
+type LagFunc func(db *sqlx.DB) (time.Duration, error)
+
+type Replica struct {
+	Name   string
+	DB     *sqlx.DB
+	Weight int
+}
+
+type ReplicaStatus struct {
+	Name    string
+	Weight  int
+	Healthy bool
+	Lag     time.Duration
+	Err     error
+	Checked time.Time
+}
+
+type ReplicaSet struct {
+	MaxLag time.Duration
+	Lag    LagFunc
+
+	mu       sync.RWMutex
+	replicas []Replica
+	status   []ReplicaStatus
+	stop     chan struct{}
+}
+
+func NewReplicaSet(lag LagFunc, maxLag time.Duration, replicas ...Replica) *ReplicaSet {
+	rs := &ReplicaSet{
+		MaxLag:   maxLag,
+		Lag:      lag,
+		replicas: replicas,
+		status:   make([]ReplicaStatus, len(replicas)),
+	}
+	for i, r := range replicas {
+		if r.Weight <= 0 {
+			rs.replicas[i].Weight = 1
+		}
+		rs.status[i] = ReplicaStatus{Name: r.Name, Weight: rs.replicas[i].Weight, Healthy: true}
+	}
+	return rs
+}
+
+// Pick returns a healthy replica chosen by weight, or nil when every
+// replica has been ejected and the caller should fall back to primary.
+func (rs *ReplicaSet) Pick() *sqlx.DB {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	total := 0
+	for i, r := range rs.replicas {
+		if rs.status[i].Healthy {
+			total += r.Weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for i, r := range rs.replicas {
+		if !rs.status[i].Healthy {
+			continue
+		}
+		if n < r.Weight {
+			return r.DB
+		}
+		n -= r.Weight
+	}
+	return nil
+}
+
+func (rs *ReplicaSet) Check() {
+	for i, r := range rs.replicas {
+		st := ReplicaStatus{Name: r.Name, Weight: r.Weight, Checked: time.Now()}
+		st.Err = r.DB.Ping()
+		if st.Err == nil && rs.Lag != nil {
+			st.Lag, st.Err = rs.Lag(r.DB)
+		}
+		st.Healthy = st.Err == nil && (rs.MaxLag <= 0 || st.Lag <= rs.MaxLag)
+		rs.mu.Lock()
+		rs.status[i] = st
+		rs.mu.Unlock()
+	}
+}
+
+func (rs *ReplicaSet) Status() []ReplicaStatus {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	status := make([]ReplicaStatus, len(rs.status))
+	copy(status, rs.status)
+	return status
+}
+
+func (rs *ReplicaSet) Start(interval time.Duration) {
+	rs.mu.Lock()
+	if rs.stop != nil {
+		rs.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	rs.stop = stop
+	rs.mu.Unlock()
+	rs.Check()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rs.Check()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (rs *ReplicaSet) Stop() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.stop != nil {
+		close(rs.stop)
+		rs.stop = nil
+	}
+}
+
+// Close stops health checks and closes every replica.
+func (rs *ReplicaSet) Close() error {
+	rs.Stop()
+	var firstErr error
+	for _, r := range rs.replicas {
+		if err := r.DB.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func MySQLLag(db *sqlx.DB) (time.Duration, error) {
+	rows, err := db.Queryx("SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errors.New("Replication not configured")
+	}
+	status := map[string]interface{}{}
+	if err = rows.MapScan(status); err != nil {
+		return 0, errors.Trace(err)
+	}
+	var seconds string
+	switch v := status["Seconds_Behind_Master"].(type) {
+	case []byte:
+		seconds = string(v)
+	case string:
+		seconds = v
+	case int64:
+		return time.Duration(v) * time.Second, nil
+	default:
+		return 0, errors.New("Replication is not running")
+	}
+	n, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+func PostgresLag(db *sqlx.DB) (time.Duration, error) {
+	var seconds sql.NullFloat64
+	err := db.Get(&seconds, "SELECT EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())")
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if !seconds.Valid {
+		return 0, errors.New("Replication is not running")
+	}
+	return time.Duration(seconds.Float64 * float64(time.Second)), nil
+}
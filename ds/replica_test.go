@@ -0,0 +1,123 @@
+package ds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	_ "modernc.org/sqlite"
+)
+
+// openNamed opens an in-memory database that answers SELECT name FROM
+// whoami with name.
+func openNamed(t *testing.T, name string) *sqlx.DB {
+	db, err := sqlx.Connect("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	db.MustExec("CREATE TABLE whoami (name TEXT)")
+	db.MustExec("INSERT INTO whoami VALUES (?)", name)
+	return db
+}
+
+func TestReplicaSetPick(t *testing.T) {
+	r1, r2 := openNamed(t, "r1"), openNamed(t, "r2")
+	lags := map[*sqlx.DB]time.Duration{r1: time.Second, r2: 10 * time.Second}
+	lag := func(db *sqlx.DB) (time.Duration, error) { return lags[db], nil }
+	rs := ds.NewReplicaSet(lag, 5*time.Second, ds.Replica{Name: "r1", DB: r1}, ds.Replica{Name: "r2", DB: r2, Weight: 3})
+
+	picked := map[*sqlx.DB]int{}
+	for i := 0; i < 400; i++ {
+		picked[rs.Pick()]++
+	}
+	assert.Len(t, picked, 2, "replicas start healthy")
+	assert.True(t, picked[r2] > picked[r1], "r2 has the larger weight")
+
+	rs.Check()
+	status := rs.Status()
+	assert.True(t, status[0].Healthy)
+	assert.False(t, status[1].Healthy, "r2 lags too much")
+	assert.Equal(t, 10*time.Second, status[1].Lag)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, r1, rs.Pick())
+	}
+
+	lags[r1] = 0
+	r1.Close()
+	rs.Check()
+	status = rs.Status()
+	assert.False(t, status[0].Healthy)
+	assert.Error(t, status[0].Err)
+	assert.Nil(t, rs.Pick(), "nothing healthy is left")
+
+	lags[r2] = time.Second
+	rs.Lag = func(db *sqlx.DB) (time.Duration, error) {
+		return 0, errors.New("replication is not running")
+	}
+	rs.Check()
+	assert.False(t, rs.Status()[1].Healthy, "lag errors eject")
+}
+
+func TestReplicaSetStartStop(t *testing.T) {
+	r1 := openNamed(t, "r1")
+	checks := make(chan struct{}, 100)
+	lag := func(db *sqlx.DB) (time.Duration, error) {
+		checks <- struct{}{}
+		return time.Hour, nil
+	}
+	rs := ds.NewReplicaSet(lag, time.Minute, ds.Replica{Name: "r1", DB: r1})
+	rs.Start(time.Millisecond)
+	assert.False(t, rs.Status()[0].Healthy, "Start checks right away")
+	rs.Start(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-checks:
+		case <-time.After(time.Second):
+			t.Fatal("no periodic check")
+		}
+	}
+	rs.Stop()
+	rs.Stop()
+	time.Sleep(10 * time.Millisecond)
+	for len(checks) > 0 {
+		<-checks
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, checks, 0, "no checks after Stop")
+}
+
+func TestReadOnlyRouting(t *testing.T) {
+	primary, r1 := openNamed(t, "primary"), openNamed(t, "r1")
+	ds.RegisterDataSource("replica_test", primary)
+	defer delete(ds.DataSources, "replica_test")
+	rs := ds.NewReplicaSet(nil, 0, ds.Replica{Name: "r1", DB: r1})
+	ds.RegisterReplicas("replica_test", rs)
+	defer delete(ds.Replicas, "replica_test")
+
+	c := ds.WithDataSource(context.Background(), "replica_test")
+	whoami := func(c context.Context) string {
+		name, err := ds.NoTx(c, func(c context.Context) (string, error) {
+			return ds.Get[string](c, "SELECT name FROM whoami")
+		})
+		assert.NoError(t, err)
+		return name
+	}
+	assert.Equal(t, "primary", whoami(c))
+	assert.Equal(t, "r1", whoami(ds.ReadOnly(c)))
+
+	name, err := ds.InTx(ds.ReadOnly(c), func(c context.Context) (string, error) {
+		return ds.Get[string](c, "SELECT name FROM whoami")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", name, "transactions stay on primary")
+
+	r1.Close()
+	rs.Check()
+	assert.Equal(t, "primary", whoami(ds.ReadOnly(c)), "falls back to primary")
+}
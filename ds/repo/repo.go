@@ -0,0 +1,315 @@
+package repo
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"golang.org/x/net/context"
+)
+
+var ErrNotFound = errors.New("Record not found")
+
+// Repository builds CRUD statements for T from its db tags and runs them on
+// the executor bound to the context, so it joins DoTx like any other query.
+type Repository[T any] struct {
+	Table string
+	// ID is the primary key column. A zero integer ID is left to the
+	// database on Insert and read back.
+	ID string
+	// SoftDelete is the *time.Time or sql.NullTime column Delete fills in
+	// instead of removing the row; empty means hard delete.
+	SoftDelete string
+	// CreatedAt and UpdatedAt are filled by Insert and Update when set.
+	CreatedAt string
+	UpdatedAt string
+	Now       func() time.Time
+
+	mapper *reflectx.Mapper
+	fields map[string]*reflectx.FieldInfo
+	cols   []string
+}
+
+// New maps T to table with "id" as primary key; deleted_at, created_at and
+// updated_at are used for soft delete and audit when T has them.
+func New[T any](table string) *Repository[T] {
+	r := &Repository[T]{
+		Table:  table,
+		ID:     "id",
+		Now:    time.Now,
+		mapper: reflectx.NewMapperFunc("db", sqlx.NameMapper),
+		fields: map[string]*reflectx.FieldInfo{},
+	}
+	var v T
+	for _, fi := range r.mapper.TypeMap(reflect.TypeOf(v)).Index {
+		// Nested struct fields are not columns of their own.
+		if fi.Embedded || strings.Contains(fi.Path, ".") {
+			continue
+		}
+		if _, ok := r.fields[fi.Path]; ok {
+			continue
+		}
+		r.fields[fi.Path] = fi
+		r.cols = append(r.cols, fi.Path)
+	}
+	if r.has("deleted_at") {
+		r.SoftDelete = "deleted_at"
+	}
+	if r.has("created_at") {
+		r.CreatedAt = "created_at"
+	}
+	if r.has("updated_at") {
+		r.UpdatedAt = "updated_at"
+	}
+	return r
+}
+
+func (r *Repository[T]) Insert(c context.Context, v *T) error {
+	rv := reflect.ValueOf(v).Elem()
+	now := r.Now()
+	undo := r.stamp(rv, now, r.CreatedAt, r.UpdatedAt)
+	var (
+		cols []string
+		args []interface{}
+	)
+	id := r.field(rv, r.ID)
+	autoID := id.IsValid() && isInt(id) && id.IsZero()
+	for _, col := range r.cols {
+		if autoID && col == r.ID {
+			continue
+		}
+		cols = append(cols, col)
+		args = append(args, r.value(rv, col))
+	}
+	query := "INSERT INTO " + r.Table + " (" + strings.Join(cols, ", ") + ") VALUES (" + ds.Placeholders(len(cols)) + ")"
+	err := ds.WithExecutor(c, func(exe ds.IExecutor) error {
+		if !autoID {
+			_, err := exe.Exec(exe.Rebind(query), args...)
+			return errors.Trace(err)
+		}
+		var n int64
+		if exe.DriverName() == "postgres" || exe.DriverName() == "pgx" {
+			if err := sqlx.Get(exe, &n, exe.Rebind(query+" RETURNING "+r.ID), args...); err != nil {
+				return errors.Trace(err)
+			}
+		} else {
+			result, err := exe.Exec(exe.Rebind(query), args...)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if n, err = result.LastInsertId(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if id.Kind() >= reflect.Uint && id.Kind() <= reflect.Uint64 {
+			id.SetUint(uint64(n))
+		} else {
+			id.SetInt(n)
+		}
+		return nil
+	})
+	if err != nil {
+		undo()
+	}
+	return err
+}
+
+// Get returns ErrNotFound for missing and soft deleted rows.
+func (r *Repository[T]) Get(c context.Context, id interface{}) (*T, error) {
+	if err := r.checkID(); err != nil {
+		return nil, err
+	}
+	v, err := ds.Get[T](c, ds.Rebind(c, r.selectFrom()+" WHERE "+r.ID+" = ?"+r.alive()), id)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &v, nil
+}
+
+// Find returns the rows matching where, which may be empty, leaving out
+// soft deleted ones.
+func (r *Repository[T]) Find(c context.Context, where string, args ...interface{}) ([]T, error) {
+	return r.find(c, where, r.alive(), args)
+}
+
+// FindWithDeleted is Find including soft deleted rows.
+func (r *Repository[T]) FindWithDeleted(c context.Context, where string, args ...interface{}) ([]T, error) {
+	return r.find(c, where, "", args)
+}
+
+func (r *Repository[T]) find(c context.Context, where, alive string, args []interface{}) ([]T, error) {
+	query := r.selectFrom() + " WHERE "
+	if where != "" {
+		query += "(" + where + ")"
+	} else {
+		query += "1 = 1"
+	}
+	query += alive
+	vs, err := ds.Select[T](c, ds.Rebind(c, query), args...)
+	return vs, errors.Trace(err)
+}
+
+// Update writes every column but the ID, CreatedAt and SoftDelete ones.
+// It returns ErrNotFound when no live row has v's ID, which MySQL only
+// tells apart from an unchanged row if UpdatedAt is set.
+func (r *Repository[T]) Update(c context.Context, v *T) error {
+	if err := r.checkID(); err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(v).Elem()
+	undo := r.stamp(rv, r.Now(), r.UpdatedAt)
+	var (
+		sets []string
+		args []interface{}
+	)
+	for _, col := range r.cols {
+		if col == r.ID || col == r.CreatedAt || col == r.SoftDelete {
+			continue
+		}
+		sets = append(sets, col+" = ?")
+		args = append(args, r.value(rv, col))
+	}
+	args = append(args, r.value(rv, r.ID))
+	n, err := r.exec(c, "UPDATE "+r.Table+" SET "+strings.Join(sets, ", ")+" WHERE "+r.ID+" = ?"+r.alive(), args...)
+	if err == nil && n == 0 && r.UpdatedAt != "" {
+		err = ErrNotFound
+	}
+	if err != nil {
+		undo()
+	}
+	return err
+}
+
+// Delete soft deletes when SoftDelete is set and removes the row otherwise.
+func (r *Repository[T]) Delete(c context.Context, id interface{}) error {
+	if err := r.checkID(); err != nil {
+		return err
+	}
+	if r.SoftDelete == "" {
+		return r.HardDelete(c, id)
+	}
+	return r.mustExec(c, "UPDATE "+r.Table+" SET "+r.SoftDelete+" = ? WHERE "+r.ID+" = ?"+r.alive(), r.Now(), id)
+}
+
+func (r *Repository[T]) HardDelete(c context.Context, id interface{}) error {
+	if err := r.checkID(); err != nil {
+		return err
+	}
+	return r.mustExec(c, "DELETE FROM "+r.Table+" WHERE "+r.ID+" = ?", id)
+}
+
+// Restore undoes a soft delete.
+func (r *Repository[T]) Restore(c context.Context, id interface{}) error {
+	if r.SoftDelete == "" {
+		return errors.Errorf("%s has no soft delete column", r.Table)
+	}
+	return r.mustExec(c, "UPDATE "+r.Table+" SET "+r.SoftDelete+" = NULL WHERE "+r.ID+" = ? AND "+r.SoftDelete+" IS NOT NULL", id)
+}
+
+func (r *Repository[T]) exec(c context.Context, query string, args ...interface{}) (int64, error) {
+	result, err := ds.Exec(c, ds.Rebind(c, query), args...)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	n, err := result.RowsAffected()
+	return n, errors.Trace(err)
+}
+
+// mustExec returns ErrNotFound when query affects no row.
+func (r *Repository[T]) mustExec(c context.Context, query string, args ...interface{}) error {
+	n, err := r.exec(c, query, args...)
+	if err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (r *Repository[T]) selectFrom() string {
+	return "SELECT " + strings.Join(r.cols, ", ") + " FROM " + r.Table
+}
+
+func (r *Repository[T]) alive() string {
+	if r.SoftDelete == "" {
+		return ""
+	}
+	return " AND " + r.SoftDelete + " IS NULL"
+}
+
+// checkID reports an ID that names no column of T, which Update would
+// otherwise panic on.
+func (r *Repository[T]) checkID() error {
+	if !r.has(r.ID) {
+		var v T
+		return errors.Errorf("%T has no ID column %s", v, r.ID)
+	}
+	return nil
+}
+
+func (r *Repository[T]) has(col string) bool {
+	_, ok := r.fields[col]
+	return ok
+}
+
+func (r *Repository[T]) field(rv reflect.Value, col string) reflect.Value {
+	fi, ok := r.fields[col]
+	if !ok {
+		return reflect.Value{}
+	}
+	return reflectx.FieldByIndexes(rv, fi.Index)
+}
+
+// value reads col without allocating nil pointers on the way, so they are
+// written as NULL.
+func (r *Repository[T]) value(rv reflect.Value, col string) interface{} {
+	return reflectx.FieldByIndexesReadOnly(rv, r.fields[col].Index).Interface()
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// stamp sets the time columns cols of rv to now and returns a func that
+// puts back what they held, for when the write fails.
+func (r *Repository[T]) stamp(rv reflect.Value, now time.Time, cols ...string) (undo func()) {
+	var fields, olds []reflect.Value
+	for _, col := range cols {
+		f := r.field(rv, col)
+		if !f.IsValid() {
+			continue
+		}
+		old := reflect.New(f.Type()).Elem()
+		old.Set(f)
+		fields, olds = append(fields, f), append(olds, old)
+		r.setTime(rv, col, now)
+	}
+	return func() {
+		for i, f := range fields {
+			f.Set(olds[i])
+		}
+	}
+}
+
+func (r *Repository[T]) setTime(rv reflect.Value, col string, now time.Time) {
+	f := r.field(rv, col)
+	if !f.IsValid() {
+		return
+	}
+	switch f.Type() {
+	case timeType:
+		f.Set(reflect.ValueOf(now))
+	case reflect.PtrTo(timeType):
+		f.Set(reflect.ValueOf(&now))
+	case reflect.TypeOf(sql.NullTime{}):
+		f.Set(reflect.ValueOf(sql.NullTime{Time: now, Valid: true}))
+	}
+}
+
+func isInt(v reflect.Value) bool {
+	return v.Kind() >= reflect.Int && v.Kind() <= reflect.Uint64
+}
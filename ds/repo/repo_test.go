@@ -0,0 +1,117 @@
+package repo_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/lysu/go-misc/ds/repo"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type user struct {
+	ID        int64      `db:"id"`
+	Name      string     `db:"name"`
+	CreatedAt time.Time  `db:"created_at"`
+	UpdatedAt time.Time  `db:"updated_at"`
+	DeletedAt *time.Time `db:"deleted_at"`
+	Ignored   string     `db:"-"`
+}
+
+func TestRepository(t *testing.T) {
+	dstest.SQLite(t)
+	c := dstest.Begin(t)
+	_, err := ds.Exec(c, `CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		deleted_at DATETIME
+	)`)
+	assert.NoError(t, err)
+
+	r := repo.New[user]("users")
+	assert.Equal(t, "deleted_at", r.SoftDelete)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	r.Now = func() time.Time { return now }
+
+	u := &user{Name: "alice"}
+	assert.NoError(t, r.Insert(c, u))
+	assert.Equal(t, int64(1), u.ID)
+	assert.Equal(t, now, u.CreatedAt)
+	assert.NoError(t, r.Insert(c, &user{Name: "bob"}))
+
+	now = now.Add(time.Hour)
+	u.Name = "carol"
+	assert.NoError(t, r.Update(c, u))
+	got, err := r.Get(c, u.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "carol", got.Name)
+	assert.True(t, got.CreatedAt.Equal(now.Add(-time.Hour)))
+	assert.True(t, got.UpdatedAt.Equal(now))
+
+	// Rolled back along with the rest of the transaction.
+	_, err = ds.DoTx(c, func(c context.Context) (interface{}, error) {
+		if err := r.Delete(c, u.ID); err != nil {
+			return nil, err
+		}
+		return nil, repo.ErrNotFound
+	})
+	assert.Equal(t, repo.ErrNotFound, err)
+	_, err = r.Get(c, u.ID)
+	assert.NoError(t, err)
+
+	assert.NoError(t, r.Delete(c, u.ID))
+	_, err = r.Get(c, u.ID)
+	assert.Equal(t, repo.ErrNotFound, err)
+	assert.Equal(t, repo.ErrNotFound, r.Delete(c, u.ID))
+	assert.Equal(t, repo.ErrNotFound, r.Update(c, u))
+	users, err := r.Find(c, "")
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+	users, err = r.FindWithDeleted(c, "name = ?", "carol")
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+	assert.NotNil(t, users[0].DeletedAt)
+
+	assert.NoError(t, r.Restore(c, u.ID))
+	_, err = r.Get(c, u.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, r.HardDelete(c, u.ID))
+	users, err = r.FindWithDeleted(c, "")
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+}
+
+func TestRepositoryFailedWrites(t *testing.T) {
+	dstest.SQLite(t)
+	c := dstest.Begin(t)
+	_, err := ds.Exec(c, `CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		deleted_at DATETIME
+	)`)
+	assert.NoError(t, err)
+	r := repo.New[user]("users")
+	assert.NoError(t, r.Insert(c, &user{Name: "alice"}))
+
+	// A failed write leaves the timestamps as they were.
+	then := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	u := &user{Name: "alice", CreatedAt: then, UpdatedAt: then}
+	assert.Error(t, r.Insert(c, u))
+	assert.Equal(t, then, u.CreatedAt)
+	assert.Equal(t, then, u.UpdatedAt)
+	u.ID = 42
+	assert.Equal(t, repo.ErrNotFound, r.Update(c, u))
+	assert.Equal(t, then, u.UpdatedAt)
+
+	r.ID = "uid"
+	_, err = r.Get(c, 1)
+	assert.Error(t, err)
+	assert.Error(t, r.Update(c, u), "an unknown ID is an error, not a panic")
+	assert.Error(t, r.Delete(c, 1))
+}
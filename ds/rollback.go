@@ -0,0 +1,84 @@
+package ds
+
+import (
+	stderrors "errors"
+
+	"github.com/juju/errors"
+)
+
+// noRollbackRule travels through DoTx's noRollbackErrs next to plain
+// sentinel errors, so rules and sentinels can be mixed freely.
+type noRollbackRule struct {
+	match func(err error) bool
+}
+
+func (r *noRollbackRule) Error() string {
+	return "no rollback rule"
+}
+
+// NoRollbackIf keeps the transaction when pred reports true for the error.
+func NoRollbackIf(pred func(err error) bool) error {
+	return &noRollbackRule{match: pred}
+}
+
+// NoRollbackOn keeps the transaction when any error in the chain is an E,
+// e.g. NoRollbackOn[*ValidationError]().
+func NoRollbackOn[E error]() error {
+	return &noRollbackRule{match: func(err error) bool {
+		var target E
+		return stderrors.As(err, &target)
+	}}
+}
+
+type commitAnywayError struct {
+	err error
+}
+
+func (e *commitAnywayError) Error() string {
+	return e.err.Error()
+}
+
+func (e *commitAnywayError) Unwrap() error {
+	return e.err
+}
+
+func (e *commitAnywayError) Cause() error {
+	return e.err
+}
+
+// CommitAnyway marks err so DoTx commits and still returns it to the caller.
+func CommitAnyway(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &commitAnywayError{err: err}
+}
+
+// keptErr is what goes back to the caller of a transaction committed
+// despite err: only a CommitAnyway error, the others are dropped.
+func keptErr(err error) error {
+	var commit *commitAnywayError
+	if stderrors.As(err, &commit) {
+		return err
+	}
+	return nil
+}
+
+func isRollbackErr(err error, noRollbackErrs []error) bool {
+	var commit *commitAnywayError
+	if stderrors.As(err, &commit) {
+		return false
+	}
+	for _, noRollbackErr := range noRollbackErrs {
+		if rule, ok := noRollbackErr.(*noRollbackRule); ok {
+			if rule.match(err) {
+				return false
+			}
+			continue
+		}
+		if stderrors.Is(err, noRollbackErr) || stderrors.Is(errors.Cause(err), noRollbackErr) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package ds
+
+import (
+	stderrors "errors"
+	"fmt"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	_ "modernc.org/sqlite"
+)
+
+var errNotFound = errors.New("not found")
+
+type validationError struct {
+	Field string
+}
+
+func (e *validationError) Error() string {
+	return "invalid " + e.Field
+}
+
+func TestIsRollbackErr(t *testing.T) {
+	assert.True(t, isRollbackErr(errors.New("boom"), nil))
+	assert.False(t, isRollbackErr(errNotFound, []error{errNotFound}))
+	assert.False(t, isRollbackErr(fmt.Errorf("load: %w", errNotFound), []error{errNotFound}))
+	assert.False(t, isRollbackErr(errors.Annotate(errNotFound, "load"), []error{errNotFound}))
+	assert.True(t, isRollbackErr(errors.New("not found"), []error{errNotFound}))
+}
+
+func TestNoRollbackRules(t *testing.T) {
+	rules := []error{
+		NoRollbackOn[*validationError](),
+		NoRollbackIf(func(err error) bool { return err.Error() == "soft" }),
+	}
+	assert.False(t, isRollbackErr(fmt.Errorf("save: %w", &validationError{Field: "name"}), rules))
+	assert.False(t, isRollbackErr(errors.New("soft"), rules))
+	assert.True(t, isRollbackErr(errors.New("hard"), rules))
+}
+
+func TestCommitAnyway(t *testing.T) {
+	err := CommitAnyway(errNotFound)
+	assert.False(t, isRollbackErr(err, nil))
+	assert.False(t, isRollbackErr(errors.Annotate(err, "load"), nil))
+	assert.Equal(t, errNotFound, errors.Cause(err))
+	assert.Nil(t, CommitAnyway(nil))
+}
+
+func TestDoTxNoRollbackErrs(t *testing.T) {
+	db, err := sqlx.Connect("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	db.MustExec("CREATE TABLE t (id INTEGER PRIMARY KEY)")
+	RegisterDataSource("rollback_test", db)
+	defer delete(DataSources, "rollback_test")
+	c := WithDataSource(context.Background(), "rollback_test")
+	insert := func(id int, ret error) error {
+		_, err := DoTx(c, func(c context.Context) (interface{}, error) {
+			exe, err := Executor(c)
+			if err != nil {
+				return nil, err
+			}
+			if _, err = exe.Exec("INSERT INTO t (id) VALUES (?)", id); err != nil {
+				return nil, err
+			}
+			return nil, ret
+		}, errNotFound, NoRollbackOn[*validationError]())
+		return err
+	}
+
+	// Kept errors commit and are dropped, as DoTx returns the commit's
+	// result; only CommitAnyway errors are still returned.
+	assert.NoError(t, insert(1, errNotFound))
+	assert.NoError(t, insert(2, fmt.Errorf("load: %w", errNotFound)))
+	assert.NoError(t, insert(3, &validationError{Field: "name"}))
+	partial := errors.New("partial")
+	assert.True(t, stderrors.Is(insert(4, CommitAnyway(partial)), partial))
+	// Any other error rolls back.
+	boom := errors.New("boom")
+	assert.Equal(t, boom, insert(5, boom))
+	assert.NoError(t, insert(6, nil))
+
+	var ids []int
+	assert.NoError(t, db.Select(&ids, "SELECT id FROM t ORDER BY id"))
+	assert.Equal(t, []int{1, 2, 3, 4, 6}, ids)
+}
@@ -0,0 +1,255 @@
+package ds
+
+import (
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+const SHARD_KEY = "_shard_"
+
+var ShardRouters = map[string]*ShardRouter{}
+
+// RegisterShardRouter makes logical a routable name: contexts selecting it
+// with DATASOURCE_KEY are sent to the shard chosen by strategy.
+func RegisterShardRouter(logical string, strategy ShardStrategy) {
+	registry.Lock()
+	defer registry.Unlock()
+	ShardRouters[logical] = &ShardRouter{Strategy: strategy}
+}
+
+func shardRouter(logical string) (*ShardRouter, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	router, ok := ShardRouters[logical]
+	return router, ok
+}
+
+func WithShardKey(c context.Context, key interface{}) context.Context {
+	return context.WithValue(c, SHARD_KEY, key)
+}
+
+type ShardStrategy interface {
+	Shard(key interface{}) (string, error)
+	Shards() []string
+}
+
+type ShardRouter struct {
+	Strategy ShardStrategy
+}
+
+func (r *ShardRouter) Route(c context.Context) (string, error) {
+	key := c.Value(SHARD_KEY)
+	if key == nil {
+		return "", errors.New("Context without any shard key")
+	}
+	return r.Strategy.Shard(key)
+}
+
+type Modulo struct {
+	DataSources []string
+}
+
+func (m *Modulo) Shard(key interface{}) (string, error) {
+	if len(m.DataSources) == 0 {
+		return "", errors.New("Modulo without any data source")
+	}
+	n, err := shardNumber(key)
+	if err != nil {
+		return "", err
+	}
+	return m.DataSources[n%uint64(len(m.DataSources))], nil
+}
+
+func (m *Modulo) Shards() []string {
+	return m.DataSources
+}
+
+type ShardRange struct {
+	// Upper is exclusive; ranges must be sorted by it.
+	Upper      int64
+	DataSource string
+}
+
+type RangeTable struct {
+	Ranges []ShardRange
+}
+
+func (t *RangeTable) Shard(key interface{}) (string, error) {
+	n, err := shardInt(key)
+	if err != nil {
+		return "", err
+	}
+	i := sort.Search(len(t.Ranges), func(i int) bool {
+		return n < t.Ranges[i].Upper
+	})
+	if i == len(t.Ranges) {
+		return "", errors.Errorf("Shard key %d out of range", n)
+	}
+	return t.Ranges[i].DataSource, nil
+}
+
+func (t *RangeTable) Shards() []string {
+	var shards []string
+	seen := map[string]bool{}
+	for _, r := range t.Ranges {
+		if !seen[r.DataSource] {
+			seen[r.DataSource] = true
+			shards = append(shards, r.DataSource)
+		}
+	}
+	return shards
+}
+
+type ConsistentHash struct {
+	dataSources []string
+	ring        []uint32
+	nodes       map[uint32]string
+}
+
+func NewConsistentHash(vnodes int, dataSources ...string) *ConsistentHash {
+	if vnodes <= 0 {
+		vnodes = 160
+	}
+	h := &ConsistentHash{dataSources: dataSources, nodes: map[uint32]string{}}
+	for _, ds := range dataSources {
+		for i := 0; i < vnodes; i++ {
+			sum := crc32.ChecksumIEEE([]byte(ds + "#" + strconv.Itoa(i)))
+			if _, ok := h.nodes[sum]; ok {
+				continue
+			}
+			h.nodes[sum] = ds
+			h.ring = append(h.ring, sum)
+		}
+	}
+	sort.Slice(h.ring, func(i, j int) bool { return h.ring[i] < h.ring[j] })
+	return h
+}
+
+func (h *ConsistentHash) Shard(key interface{}) (string, error) {
+	if len(h.ring) == 0 {
+		return "", errors.New("ConsistentHash without any data source")
+	}
+	sum := crc32.ChecksumIEEE([]byte(fmt.Sprint(key)))
+	i := sort.Search(len(h.ring), func(i int) bool { return h.ring[i] >= sum })
+	if i == len(h.ring) {
+		i = 0
+	}
+	return h.nodes[h.ring[i]], nil
+}
+
+func (h *ConsistentHash) Shards() []string {
+	return h.dataSources
+}
+
+// Scatter runs query on every shard of logical concurrently and merges the
+// rows in shard order.
+func Scatter(c context.Context, logical string, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	router, ok := shardRouter(logical)
+	if !ok {
+		return nil, errors.Errorf("No shard router for %s", logical)
+	}
+	shards := router.Strategy.Shards()
+	results := make([][]map[string]interface{}, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard string) {
+			defer wg.Done()
+			_, errs[i] = DoNoTx(WithDataSource(c, shard), func(c context.Context) (interface{}, error) {
+				exe, err := Executor(c)
+				if err != nil {
+					return nil, err
+				}
+				rows, err := exe.Queryx(query, args...)
+				if err != nil {
+					return nil, err
+				}
+				defer rows.Close()
+				for rows.Next() {
+					row := map[string]interface{}{}
+					if err = rows.MapScan(row); err != nil {
+						return nil, err
+					}
+					results[i] = append(results[i], row)
+				}
+				return nil, rows.Err()
+			})
+		}(i, shard)
+	}
+	wg.Wait()
+	var merged []map[string]interface{}
+	for i, shard := range shards {
+		if errs[i] != nil {
+			return nil, errors.Annotatef(errs[i], "shard %s", shard)
+		}
+		merged = append(merged, results[i]...)
+	}
+	return merged, nil
+}
+
+// shardNumber treats decimal strings like the integers they spell, so a
+// key routes the same whether it came as 7 or "7". Other strings are
+// hashed.
+func shardNumber(key interface{}) (uint64, error) {
+	switch k := key.(type) {
+	case uint:
+		return uint64(k), nil
+	case uint64:
+		return k, nil
+	case string:
+		if n, err := strconv.ParseUint(k, 10, 64); err == nil {
+			return n, nil
+		}
+		if _, err := strconv.ParseInt(k, 10, 64); err != nil {
+			h := fnv.New64a()
+			h.Write([]byte(k))
+			return h.Sum64(), nil
+		}
+	case []byte:
+		h := fnv.New64a()
+		h.Write(k)
+		return h.Sum64(), nil
+	}
+	n, err := shardInt(key)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		// -n overflows for math.MinInt64.
+		return uint64(-(n + 1)) + 1, nil
+	}
+	return uint64(n), nil
+}
+
+func shardInt(key interface{}) (int64, error) {
+	switch k := key.(type) {
+	case int:
+		return int64(k), nil
+	case int32:
+		return int64(k), nil
+	case int64:
+		return k, nil
+	case uint:
+		return shardInt(uint64(k))
+	case uint32:
+		return int64(k), nil
+	case uint64:
+		if k > math.MaxInt64 {
+			return 0, errors.Errorf("Shard key %d overflows int64", k)
+		}
+		return int64(k), nil
+	case string:
+		n, err := strconv.ParseInt(k, 10, 64)
+		return n, errors.Trace(err)
+	}
+	return 0, errors.Errorf("Unsupported shard key type %T", key)
+}
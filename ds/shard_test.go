@@ -0,0 +1,158 @@
+package ds_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/lysu/go-misc/ds"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestModulo(t *testing.T) {
+	m := &ds.Modulo{DataSources: []string{"s0", "s1", "s2"}}
+	shard, err := m.Shard(int64(7))
+	assert.NoError(t, err)
+	assert.Equal(t, "s1", shard)
+
+	shard, err = m.Shard("user-1")
+	assert.NoError(t, err)
+	again, _ := m.Shard("user-1")
+	assert.Equal(t, shard, again)
+
+	_, err = m.Shard(1.5)
+	assert.Error(t, err)
+
+	shard, err = m.Shard("7")
+	assert.NoError(t, err)
+	assert.Equal(t, "s1", shard, "decimal strings route like integers")
+	shard, err = m.Shard(uint64(math.MaxUint64))
+	assert.NoError(t, err)
+	assert.Equal(t, "s0", shard)
+	shard, err = m.Shard(int64(math.MinInt64))
+	assert.NoError(t, err)
+	assert.Equal(t, "s2", shard)
+}
+
+func TestRangeTable(t *testing.T) {
+	r := &ds.RangeTable{Ranges: []ds.ShardRange{
+		{Upper: 100, DataSource: "s0"},
+		{Upper: 200, DataSource: "s1"},
+	}}
+	shard, err := r.Shard(99)
+	assert.NoError(t, err)
+	assert.Equal(t, "s0", shard)
+
+	shard, err = r.Shard(100)
+	assert.NoError(t, err)
+	assert.Equal(t, "s1", shard)
+
+	_, err = r.Shard(200)
+	assert.Error(t, err)
+
+	shard, err = r.Shard("99")
+	assert.NoError(t, err)
+	assert.Equal(t, "s0", shard)
+	_, err = r.Shard("user-1")
+	assert.Error(t, err)
+	_, err = r.Shard(uint64(math.MaxUint64))
+	assert.Error(t, err, "no wrapping around to negative keys")
+	assert.Equal(t, []string{"s0", "s1"}, r.Shards())
+}
+
+func TestConsistentHash(t *testing.T) {
+	h := ds.NewConsistentHash(0, "s0", "s1", "s2")
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		shard, err := h.Shard(fmt.Sprintf("key-%d", i))
+		assert.NoError(t, err)
+		counts[shard]++
+	}
+	assert.Len(t, counts, 3)
+
+	grown := ds.NewConsistentHash(0, "s0", "s1", "s2", "s3")
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before, _ := h.Shard(key)
+		after, _ := grown.Shard(key)
+		if before != after {
+			assert.Equal(t, "s3", after)
+			moved++
+		}
+	}
+	assert.True(t, moved < 1500)
+}
+
+func TestRouteWithoutShardKey(t *testing.T) {
+	ds.RegisterShardRouter("orders", &ds.Modulo{DataSources: []string{"s0"}})
+	defer delete(ds.ShardRouters, "orders")
+
+	c := ds.WithDataSource(context.Background(), "orders")
+	_, err := ds.DoNoTx(c, func(c context.Context) (interface{}, error) {
+		return nil, nil
+	})
+	assert.Error(t, err)
+}
+
+func TestRouteToUnknownDataSource(t *testing.T) {
+	ds.RegisterShardRouter("orders", &ds.Modulo{DataSources: []string{"missing"}})
+	defer delete(ds.ShardRouters, "orders")
+
+	c := ds.WithShardKey(ds.WithDataSource(context.Background(), "orders"), 1)
+	called := false
+	_, err := ds.DoNoTx(c, func(c context.Context) (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	assert.Error(t, err)
+	_, err = ds.DoTx(c, func(c context.Context) (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	assert.Error(t, err)
+	assert.False(t, called)
+}
+
+func registerShards(t *testing.T) {
+	for _, name := range []string{"s0", "s1"} {
+		ds.RegisterDataSource(name, openNamed(t, name))
+		name := name
+		t.Cleanup(func() { delete(ds.DataSources, name) })
+	}
+	ds.RegisterShardRouter("orders", &ds.Modulo{DataSources: []string{"s0", "s1"}})
+	t.Cleanup(func() { delete(ds.ShardRouters, "orders") })
+}
+
+func TestRouteToShard(t *testing.T) {
+	registerShards(t)
+	whoami := func(c context.Context) (string, error) {
+		return ds.Get[string](c, "SELECT name FROM whoami")
+	}
+	for key, want := range map[int]string{4: "s0", 7: "s1"} {
+		c := ds.WithShardKey(ds.WithDataSource(context.Background(), "orders"), key)
+		got, err := ds.NoTx(c, whoami)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+		got, err = ds.InTx(c, whoami)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+}
+
+func TestScatter(t *testing.T) {
+	registerShards(t)
+	rows, err := ds.Scatter(context.Background(), "orders", "SELECT name FROM whoami WHERE name <> ?", "none")
+	assert.NoError(t, err)
+	var names []interface{}
+	for _, row := range rows {
+		names = append(names, row["name"])
+	}
+	assert.Equal(t, []interface{}{"s0", "s1"}, names, "merged in shard order")
+
+	_, err = ds.Scatter(context.Background(), "orders", "SELECT nope FROM whoami")
+	assert.Error(t, err)
+	_, err = ds.Scatter(context.Background(), "missing", "SELECT 1")
+	assert.Error(t, err)
+}
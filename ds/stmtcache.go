@@ -0,0 +1,293 @@
+package ds
+
+import (
+	"container/list"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+var StmtCaches = map[string]*StmtCache{}
+
+// EnableStmtCache prepares statements of ds once and reuses them, keeping
+// at most size of them. Inside DoTx they are rebound with tx.Stmtx.
+func EnableStmtCache(ds string, size int) (*StmtCache, error) {
+	db, err := DataSource(ds)
+	if err != nil {
+		return nil, err
+	}
+	sc := NewStmtCache(db, size)
+	registry.Lock()
+	StmtCaches[ds] = sc
+	registry.Unlock()
+	return sc, nil
+}
+
+func stmtCache(ds string) *StmtCache {
+	registry.RLock()
+	defer registry.RUnlock()
+	return StmtCaches[ds]
+}
+
+type StmtCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Size      int
+}
+
+func (s StmtCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type StmtCache struct {
+	db      *sqlx.DB
+	size    int
+	mu      sync.Mutex
+	lru     *list.List
+	items   map[string]*list.Element
+	warming map[string]bool
+	stats   StmtCacheStats
+	closed  bool
+}
+
+type cachedStmt struct {
+	query   string
+	stmt    *sqlx.Stmt
+	refs    int
+	evicted bool
+}
+
+func NewStmtCache(db *sqlx.DB, size int) *StmtCache {
+	return &StmtCache{
+		db:      db,
+		size:    size,
+		lru:     list.New(),
+		items:   map[string]*list.Element{},
+		warming: map[string]bool{},
+	}
+}
+
+// lookup pins the cached statement for query so eviction cannot close it
+// while it is being executed. It returns nil on a miss.
+func (sc *StmtCache) lookup(query string) *cachedStmt {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	el, ok := sc.items[query]
+	if !ok {
+		sc.stats.Misses++
+		return nil
+	}
+	sc.lru.MoveToFront(el)
+	cs := el.Value.(*cachedStmt)
+	cs.refs++
+	sc.stats.Hits++
+	return cs
+}
+
+// prepare adds query to the cache and returns it pinned, or nil once the
+// cache is closed.
+func (sc *StmtCache) prepare(query string) (*cachedStmt, error) {
+	stmt, err := sc.db.Preparex(query)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.closed {
+		stmt.Close()
+		return nil, nil
+	}
+	if el, ok := sc.items[query]; ok {
+		// Someone else prepared it meanwhile.
+		stmt.Close()
+		cs := el.Value.(*cachedStmt)
+		cs.refs++
+		return cs, nil
+	}
+	cs := &cachedStmt{query: query, stmt: stmt, refs: 1}
+	sc.items[query] = sc.lru.PushFront(cs)
+	for sc.size > 0 && sc.lru.Len() > sc.size {
+		el := sc.lru.Back()
+		old := el.Value.(*cachedStmt)
+		sc.lru.Remove(el)
+		delete(sc.items, old.query)
+		sc.stats.Evictions++
+		old.evicted = true
+		if old.refs == 0 {
+			old.stmt.Close()
+		}
+	}
+	return cs, nil
+}
+
+// warm prepares query in the background. Misses inside a transaction use
+// it, as waiting there for a second connection of the pool may deadlock.
+func (sc *StmtCache) warm(query string) {
+	sc.mu.Lock()
+	if sc.warming[query] {
+		sc.mu.Unlock()
+		return
+	}
+	sc.warming[query] = true
+	sc.mu.Unlock()
+	go func() {
+		if cs, err := sc.prepare(query); err == nil && cs != nil {
+			sc.release(cs)
+		}
+		sc.mu.Lock()
+		delete(sc.warming, query)
+		sc.mu.Unlock()
+	}()
+}
+
+func (sc *StmtCache) release(cs *cachedStmt) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	cs.refs--
+	if cs.evicted && cs.refs == 0 {
+		cs.stmt.Close()
+	}
+}
+
+func (sc *StmtCache) Stats() StmtCacheStats {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	stats := sc.stats
+	stats.Size = sc.lru.Len()
+	return stats
+}
+
+func (sc *StmtCache) String() string {
+	b, _ := json.Marshal(sc.Stats())
+	return string(b)
+}
+
+// Close closes every cached statement; statements in use are closed when
+// released. Queries still run, unprepared, after it.
+func (sc *StmtCache) Close() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.closed = true
+	for el := sc.lru.Front(); el != nil; el = el.Next() {
+		cs := el.Value.(*cachedStmt)
+		cs.evicted = true
+		if cs.refs == 0 {
+			cs.stmt.Close()
+		}
+	}
+	sc.lru.Init()
+	sc.items = map[string]*list.Element{}
+}
+
+// NoStmtCache makes DoTx and DoNoTx under the returned context skip the
+// statement cache, for one-off SQL like migrations.
+func NoStmtCache(c context.Context) context.Context {
+	return context.WithValue(c, NO_STMT_CACHE_KEY, true)
+}
+
+func noStmtCache(c context.Context) bool {
+	skip, _ := c.Value(NO_STMT_CACHE_KEY).(bool)
+	return skip
+}
+
+// cacheable leaves DDL and other statements that rarely repeat out of the
+// cache.
+func cacheable(query string) bool {
+	query = strings.TrimSpace(query)
+	i := strings.IndexFunc(query, func(r rune) bool { return !unicode.IsLetter(r) })
+	if i >= 0 {
+		query = query[:i]
+	}
+	switch strings.ToUpper(query) {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "REPLACE", "WITH":
+		return true
+	}
+	return false
+}
+
+type cachedExecutor struct {
+	IExecutor
+	cache *StmtCache
+	tx    *sqlx.Tx
+}
+
+// stmt returns the cached statement for query, pinned, or nil when query is
+// to run unprepared: it is not cacheable, or it missed inside a
+// transaction. Waiting there for a second connection of the pool to
+// prepare on may deadlock, so it is prepared in the background instead.
+func (e *cachedExecutor) stmt(query string) (*cachedStmt, error) {
+	if !cacheable(query) {
+		return nil, nil
+	}
+	if cs := e.cache.lookup(query); cs != nil {
+		return cs, nil
+	}
+	if e.tx != nil {
+		e.cache.warm(query)
+		return nil, nil
+	}
+	return e.cache.prepare(query)
+}
+
+func (e *cachedExecutor) bind(cs *cachedStmt) *sqlx.Stmt {
+	if e.tx != nil {
+		return e.tx.Stmtx(cs.stmt)
+	}
+	return cs.stmt
+}
+
+func (e *cachedExecutor) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	cs, err := e.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	if cs == nil {
+		return e.IExecutor.Query(query, args...)
+	}
+	defer e.cache.release(cs)
+	return e.bind(cs).Query(args...)
+}
+
+func (e *cachedExecutor) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	cs, err := e.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	if cs == nil {
+		return e.IExecutor.Queryx(query, args...)
+	}
+	defer e.cache.release(cs)
+	return e.bind(cs).Queryx(args...)
+}
+
+func (e *cachedExecutor) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	cs, err := e.stmt(query)
+	if err != nil || cs == nil {
+		// sqlx.Row cannot carry our error, let the unprepared query report it.
+		return e.IExecutor.QueryRowx(query, args...)
+	}
+	defer e.cache.release(cs)
+	return e.bind(cs).QueryRowx(args...)
+}
+
+func (e *cachedExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	cs, err := e.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	if cs == nil {
+		return e.IExecutor.Exec(query, args...)
+	}
+	defer e.cache.release(cs)
+	return e.bind(cs).Exec(args...)
+}
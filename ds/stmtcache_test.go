@@ -0,0 +1,106 @@
+package ds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestStmtCache(t *testing.T) {
+	db := dstest.SQLite(t)
+	db.MustExec("CREATE TABLE kv (k TEXT PRIMARY KEY, v TEXT)")
+	sc, err := ds.EnableStmtCache(ds.DEFAULT_DATASOURCE, 2)
+	assert.NoError(t, err)
+	defer func() {
+		sc.Close()
+		delete(ds.StmtCaches, ds.DEFAULT_DATASOURCE)
+	}()
+	c := context.Background()
+
+	for _, k := range []string{"a", "b", "c"} {
+		_, err = ds.Exec(c, "INSERT INTO kv VALUES (?, ?)", k, k+k)
+		assert.NoError(t, err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		v, err := ds.Get[string](c, "SELECT v FROM kv WHERE k = ?", k)
+		assert.NoError(t, err)
+		assert.Equal(t, k+k, v)
+	}
+	_, err = ds.Select[string](c, "SELECT k FROM kv")
+	assert.NoError(t, err)
+	_, err = ds.Select[string](c, "SELECT k FROM kv")
+	assert.NoError(t, err)
+
+	stats := sc.Stats()
+	assert.Equal(t, int64(5), stats.Hits)
+	assert.Equal(t, int64(3), stats.Misses)
+	assert.Equal(t, int64(1), stats.Evictions)
+	assert.Equal(t, 2, stats.Size)
+	assert.InDelta(t, 5.0/8, stats.HitRate(), 0.001)
+
+	// Cached or not, statements work inside a transaction.
+	_, err = ds.DoTx(c, func(c context.Context) (interface{}, error) {
+		if _, err := ds.Exec(c, "UPDATE kv SET v = ? WHERE k = ?", "x", "a"); err != nil {
+			return nil, err
+		}
+		return ds.Get[string](c, "SELECT v FROM kv WHERE k = ?", "a")
+	})
+	assert.NoError(t, err)
+	v, err := ds.Get[string](c, "SELECT v FROM kv WHERE k = ?", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "x", v)
+}
+
+func TestStmtCacheSkips(t *testing.T) {
+	dstest.SQLite(t)
+	sc, err := ds.EnableStmtCache(ds.DEFAULT_DATASOURCE, 0)
+	assert.NoError(t, err)
+	defer func() {
+		sc.Close()
+		delete(ds.StmtCaches, ds.DEFAULT_DATASOURCE)
+	}()
+	c := context.Background()
+
+	_, err = ds.Exec(c, "CREATE TABLE kv (k TEXT PRIMARY KEY, v TEXT)")
+	assert.NoError(t, err)
+	_, err = ds.Exec(ds.NoStmtCache(c), "INSERT INTO kv VALUES ('a', 'b')")
+	assert.NoError(t, err)
+	assert.Equal(t, ds.StmtCacheStats{}, sc.Stats(), "DDL and NoStmtCache bypass the cache")
+
+	// A miss inside a transaction runs unprepared and warms the cache.
+	v, err := ds.InTx(c, func(c context.Context) (string, error) {
+		return ds.Get[string](c, "SELECT v FROM kv WHERE k = ?", "a")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "b", v)
+	assert.Equal(t, int64(1), sc.Stats().Misses)
+	deadline := time.Now().Add(time.Second)
+	for sc.Stats().Size == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	v, err = ds.InTx(c, func(c context.Context) (string, error) {
+		return ds.Get[string](c, "SELECT v FROM kv WHERE k = ?", "a")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "b", v)
+	assert.Equal(t, ds.StmtCacheStats{Hits: 1, Misses: 1, Size: 1}, sc.Stats())
+
+	sc.Close()
+	v, err = ds.Get[string](c, "SELECT v FROM kv WHERE k = ?", "a")
+	assert.NoError(t, err, "a closed cache runs queries unprepared")
+	assert.Equal(t, "b", v)
+	assert.Equal(t, 0, sc.Stats().Size)
+}
+
+func TestCloseStmtCaches(t *testing.T) {
+	dstest.SQLite(t)
+	_, err := ds.EnableStmtCache(ds.DEFAULT_DATASOURCE, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.Close())
+	assert.Empty(t, ds.StmtCaches)
+	assert.Empty(t, ds.DataSources)
+}
@@ -0,0 +1,90 @@
+package ds
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/net/context"
+)
+
+func InTx[T any](c context.Context, f func(c context.Context) (T, error), noRollbackErrs ...error) (T, error) {
+	var v T
+	_, err := DoTx(c, func(c context.Context) (interface{}, error) {
+		var err error
+		v, err = f(c)
+		return nil, err
+	}, noRollbackErrs...)
+	return v, err
+}
+
+func NoTx[T any](c context.Context, f func(c context.Context) (T, error)) (T, error) {
+	var v T
+	_, err := DoNoTx(c, func(c context.Context) (interface{}, error) {
+		var err error
+		v, err = f(c)
+		return nil, err
+	})
+	return v, err
+}
+
+func Get[T any](c context.Context, query string, args ...interface{}) (T, error) {
+	var v T
+	err := WithExecutor(c, func(exe IExecutor) error {
+		return sqlx.Get(exe, &v, query, args...)
+	})
+	return v, err
+}
+
+func Select[T any](c context.Context, query string, args ...interface{}) ([]T, error) {
+	var vs []T
+	err := WithExecutor(c, func(exe IExecutor) error {
+		return sqlx.Select(exe, &vs, query, args...)
+	})
+	return vs, err
+}
+
+func Exec(c context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := WithExecutor(c, func(exe IExecutor) (err error) {
+		result, err = exe.Exec(query, args...)
+		return
+	})
+	return result, err
+}
+
+// Rebind converts ? placeholders for the driver of the executor bound to c,
+// or of c's data source outside DoTx and DoNoTx.
+func Rebind(c context.Context, query string) string {
+	if exe, err := Executor(c); err == nil {
+		return exe.Rebind(query)
+	}
+	if dsKey, err := dataSourceKey(c); err == nil {
+		if db, err := DataSource(dsKey); err == nil {
+			return db.Rebind(query)
+		}
+	}
+	return query
+}
+
+// WithExecutor runs f on the executor bound to c, falling back to DoNoTx
+// when c is not inside DoTx or DoNoTx.
+func WithExecutor(c context.Context, f func(exe IExecutor) error) error {
+	if exe, err := Executor(c); err == nil {
+		return f(exe)
+	}
+	_, err := DoNoTx(c, func(c context.Context) (interface{}, error) {
+		exe, err := Executor(c)
+		if err != nil {
+			return nil, err
+		}
+		return nil, f(exe)
+	})
+	return err
+}
+
+// Placeholders returns n comma separated ? placeholders, for column and IN
+// lists.
+func Placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
@@ -0,0 +1,64 @@
+package ds_test
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+	"github.com/lysu/go-misc/ds"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	_ "modernc.org/sqlite"
+)
+
+type user struct {
+	ID   int64  `db:"id"`
+	Name string `db:"name"`
+}
+
+func TestTyped(t *testing.T) {
+	db, err := sqlx.Connect("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	db.MustExec("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL)")
+	ds.RegisterDataSource("typed_test", db)
+	defer delete(ds.DataSources, "typed_test")
+	c := ds.WithDataSource(context.Background(), "typed_test")
+
+	// Outside DoTx the helpers run on their own.
+	result, err := ds.Exec(c, "INSERT INTO users (id, name) VALUES (?, ?)", 1, "ann")
+	assert.NoError(t, err)
+	n, _ := result.RowsAffected()
+	assert.Equal(t, int64(1), n)
+
+	id, err := ds.InTx(c, func(c context.Context) (int64, error) {
+		if _, err := ds.Exec(c, "INSERT INTO users (id, name) VALUES (?, ?)", 2, "bob"); err != nil {
+			return 0, err
+		}
+		return ds.Get[int64](c, "SELECT MAX(id) FROM users")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), id)
+
+	boom := errors.New("boom")
+	_, err = ds.InTx(c, func(c context.Context) (string, error) {
+		ds.Exec(c, "INSERT INTO users (id, name) VALUES (?, ?)", 3, "cid")
+		return "", boom
+	})
+	assert.Equal(t, boom, err)
+
+	users, err := ds.NoTx(c, func(c context.Context) ([]user, error) {
+		return ds.Select[user](c, "SELECT id, name FROM users ORDER BY id")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []user{{1, "ann"}, {2, "bob"}}, users)
+
+	u, err := ds.Get[user](c, "SELECT id, name FROM users WHERE id = ?", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", u.Name)
+	_, err = ds.Get[user](c, "SELECT id, name FROM users WHERE id = ?", 9)
+	assert.Error(t, err)
+}
@@ -0,0 +1,103 @@
+package ds
+
+import (
+	stderrors "errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+)
+
+var (
+	ErrStaleVersion = errors.New("Stale version")
+	ErrRowNotFound  = errors.New("Row not found")
+)
+
+type StaleVersionError struct {
+	Table   string
+	ID      interface{}
+	Version int64
+}
+
+func (e *StaleVersionError) Error() string {
+	return fmt.Sprintf("Stale version %d of %s %v", e.Version, e.Table, e.ID)
+}
+
+func (e *StaleVersionError) Unwrap() error {
+	return ErrStaleVersion
+}
+
+func (e *StaleVersionError) Cause() error {
+	return ErrStaleVersion
+}
+
+// UpdateVersioned sets the given columns and bumps version, but only if
+// the row is still at version; otherwise it returns *StaleVersionError, or
+// ErrRowNotFound when there is no row with id at all.
+func UpdateVersioned(c context.Context, table string, id interface{}, version int64, set map[string]interface{}) error {
+	columns := make([]string, 0, len(set))
+	for column := range set {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	assigns := make([]string, 0, len(columns)+1)
+	args := make([]interface{}, 0, len(columns)+2)
+	for _, column := range columns {
+		assigns = append(assigns, column+" = ?")
+		args = append(args, set[column])
+	}
+	assigns = append(assigns, "version = version + 1")
+	args = append(args, id, version)
+	query := "UPDATE " + table + " SET " + strings.Join(assigns, ", ") + " WHERE id = ? AND version = ?"
+	return WithExecutor(c, func(exe IExecutor) error {
+		result, err := exe.Exec(exe.Rebind(query), args...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if n > 0 {
+			return nil
+		}
+		var count int
+		if err = sqlx.Get(exe, &count, exe.Rebind("SELECT COUNT(*) FROM "+table+" WHERE id = ?"), id); err != nil {
+			return errors.Trace(err)
+		}
+		if count == 0 {
+			return errors.Annotatef(ErrRowNotFound, "%s %v", table, id)
+		}
+		return &StaleVersionError{Table: table, ID: id, Version: version}
+	})
+}
+
+// RetryOnStale loads a row and applies mutate to it inside DoTx, starting
+// over with a fresh load while mutate fails with ErrStaleVersion. It tries
+// at least once, even when attempts is not positive.
+func RetryOnStale[T any](c context.Context, attempts int, load func(c context.Context) (T, error),
+	mutate func(c context.Context, v T) error) (T, error) {
+	var (
+		v   T
+		err error
+	)
+	if attempts <= 0 {
+		attempts = 1
+	}
+	for i := 0; i < attempts; i++ {
+		v, err = InTx(c, func(c context.Context) (T, error) {
+			v, err := load(c)
+			if err != nil {
+				return v, err
+			}
+			return v, mutate(c, v)
+		})
+		if !stderrors.Is(err, ErrStaleVersion) {
+			return v, err
+		}
+	}
+	return v, err
+}
@@ -0,0 +1,88 @@
+package ds_test
+
+import (
+	stderrors "errors"
+	"testing"
+
+	"github.com/lysu/go-misc/ds"
+	"github.com/lysu/go-misc/ds/dstest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type account struct {
+	ID      int64 `db:"id"`
+	Balance int   `db:"balance"`
+	Version int64 `db:"version"`
+}
+
+func setupAccounts(t *testing.T) context.Context {
+	db := dstest.SQLite(t)
+	db.MustExec("CREATE TABLE accounts (id INTEGER PRIMARY KEY, balance INT NOT NULL, version INT NOT NULL DEFAULT 0)")
+	db.MustExec("INSERT INTO accounts (id, balance) VALUES (1, 100)")
+	return context.Background()
+}
+
+func loadAccount(c context.Context) (*account, error) {
+	a, err := ds.Get[account](c, "SELECT id, balance, version FROM accounts WHERE id = 1")
+	return &a, err
+}
+
+func TestUpdateVersioned(t *testing.T) {
+	c := setupAccounts(t)
+	assert.NoError(t, ds.UpdateVersioned(c, "accounts", 1, 0, map[string]interface{}{"balance": 90}))
+	a, err := loadAccount(c)
+	assert.NoError(t, err)
+	assert.Equal(t, &account{ID: 1, Balance: 90, Version: 1}, a)
+
+	err = ds.UpdateVersioned(c, "accounts", 1, 0, map[string]interface{}{"balance": 80})
+	assert.True(t, stderrors.Is(err, ds.ErrStaleVersion))
+	var stale *ds.StaleVersionError
+	assert.True(t, stderrors.As(err, &stale))
+	assert.Equal(t, int64(0), stale.Version)
+
+	err = ds.UpdateVersioned(c, "accounts", 2, 0, map[string]interface{}{"balance": 80})
+	assert.True(t, stderrors.Is(err, ds.ErrRowNotFound))
+	assert.False(t, stderrors.Is(err, ds.ErrStaleVersion))
+}
+
+func TestRetryOnStale(t *testing.T) {
+	c := setupAccounts(t)
+	loads := 0
+	// The first load returns an out of date copy.
+	load := func(c context.Context) (*account, error) {
+		loads++
+		a, err := loadAccount(c)
+		if loads == 1 {
+			a.Balance, a.Version = 50, a.Version-1
+		}
+		return a, err
+	}
+	tries := 0
+	a, err := ds.RetryOnStale(c, 3, load, func(c context.Context, a *account) error {
+		tries++
+		return ds.UpdateVersioned(c, "accounts", a.ID, a.Version, map[string]interface{}{"balance": a.Balance - 10})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, tries)
+	assert.Equal(t, 100, a.Balance, "the second attempt loaded again")
+	a, err = loadAccount(c)
+	assert.NoError(t, err)
+	assert.Equal(t, &account{ID: 1, Balance: 90, Version: 1}, a)
+
+	tries = 0
+	_, err = ds.RetryOnStale(c, 2, loadAccount, func(c context.Context, a *account) error {
+		tries++
+		return ds.UpdateVersioned(c, "accounts", a.ID, a.Version+1, map[string]interface{}{"balance": 0})
+	})
+	assert.True(t, stderrors.Is(err, ds.ErrStaleVersion))
+	assert.Equal(t, 2, tries)
+
+	tries = 0
+	_, err = ds.RetryOnStale(c, 0, loadAccount, func(c context.Context, a *account) error {
+		tries++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, tries, "runs at least once")
+}
@@ -1,31 +1,131 @@
 package net
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
 	"net"
-	"net/url"
+	"os"
 	"strings"
+	"syscall"
 )
 
-func isNetworkError(_err error) bool {
-	if _err == nil {
-		return false
+// ErrorClass is the kind of network failure an error stands for.
+type ErrorClass int
+
+const (
+	// ERR_NONE is for nil and errors that are not network failures.
+	ERR_NONE ErrorClass = iota
+	ERR_TIMEOUT
+	ERR_REFUSED
+	ERR_RESET
+	ERR_DNS
+	ERR_TLS
+	// ERR_CLOSED is a connection closed on this side, e.g. by a pool.
+	ERR_CLOSED
+	// ERR_EOF is the peer hanging up in the middle of a response.
+	ERR_EOF
+	// ERR_OTHER is any other network failure.
+	ERR_OTHER
+)
+
+var errorClassNames = []string{"none", "timeout", "refused", "reset", "dns", "tls", "closed", "eof", "other"}
+
+func (ec ErrorClass) String() string {
+	if ec < 0 || int(ec) >= len(errorClassNames) {
+		return "unknown"
 	}
-	switch t := _err.(type) {
-	case net.Error:
-		if t.Timeout() {
-			return true
-		}
-		return true
-	case *url.Error:
-		if nestErr, ok := t.Err.(net.Error); ok {
-			if nestErr.Timeout() {
-				return true
-			}
-			return true
-		}
-	}
-	if _err != nil && strings.Contains(_err.Error(), "use of closed network connection") {
+	return errorClassNames[ec]
+}
+
+// Retryable tells whether a request that failed this way may be sent
+// again. Non-idempotent requests only may when they cannot have reached
+// the server; TLS failures are mostly certificates and come back anyway.
+func (ec ErrorClass) Retryable(idempotent bool) bool {
+	switch ec {
+	case ERR_REFUSED, ERR_DNS:
 		return true
+	case ERR_TIMEOUT, ERR_RESET, ERR_CLOSED, ERR_EOF, ERR_OTHER:
+		return idempotent
 	}
 	return false
 }
+
+// Classify looks through the wrapping of err, like *url.Error,
+// *net.OpError and *os.SyscallError, for what failed.
+func Classify(err error) ErrorClass {
+	if err == nil {
+		return ERR_NONE
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ERR_DNS
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ERR_REFUSED
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE):
+		return ERR_RESET
+	case errors.Is(err, net.ErrClosed):
+		return ERR_CLOSED
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return ERR_TIMEOUT
+	}
+	if isTLS(err) {
+		return ERR_TLS
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ERR_TIMEOUT
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ERR_EOF
+	}
+	// Before net.ErrClosed some errors only had the text.
+	if strings.Contains(err.Error(), "use of closed network connection") {
+		return ERR_CLOSED
+	}
+	var opErr *net.OpError
+	if errors.As(err, &netErr) || errors.As(err, &opErr) {
+		return ERR_OTHER
+	}
+	var sysErr *os.SyscallError
+	if errors.As(err, &sysErr) {
+		return ERR_OTHER
+	}
+	return ERR_NONE
+}
+
+func isTLS(err error) bool {
+	var (
+		recordErr  tls.RecordHeaderError
+		alertErr   tls.AlertError
+		verifyErr  *tls.CertificateVerificationError
+		authErr    x509.UnknownAuthorityError
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authErr) || errors.As(err, &hostErr) || errors.As(err, &invalidErr) {
+		return true
+	}
+	// crypto/tls reports most handshake failures as plain errors.
+	msg := err.Error()
+	return strings.HasPrefix(msg, "tls: ") || strings.Contains(msg, ": tls: ")
+}
+
+func IsNetworkError(err error) bool {
+	return Classify(err) != ERR_NONE
+}
+
+// Retryable is ErrorClass.Retryable, except that anything but TLS failing
+// while dialing is safe to retry as nothing was sent yet.
+func Retryable(err error, idempotent bool) bool {
+	ec := Classify(err)
+	if ec.Retryable(idempotent) {
+		return true
+	}
+	var opErr *net.OpError
+	return ec != ERR_NONE && ec != ERR_TLS && errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,84 @@
+package net_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	mnet "github.com/lysu/go-misc/net"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "HTTP/1.0 400 Bad Request\r\n\r\n")
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+	_, timeoutErr := conn.Read(make([]byte, 1))
+	conn.Close()
+	_, closedErr := conn.Read(make([]byte, 1))
+	_, tlsErr := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	ln.Close()
+	_, refusedErr := net.Dial("tcp", addr)
+
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	cases := []struct {
+		err   error
+		class mnet.ErrorClass
+	}{
+		{nil, mnet.ERR_NONE},
+		{errors.New("boom"), mnet.ERR_NONE},
+		{timeoutErr, mnet.ERR_TIMEOUT},
+		{closedErr, mnet.ERR_CLOSED},
+		{tlsErr, mnet.ERR_TLS},
+		{refusedErr, mnet.ERR_REFUSED},
+		{reset, mnet.ERR_RESET},
+		{&url.Error{Op: "Post", URL: "http://x", Err: reset}, mnet.ERR_RESET},
+		{&url.Error{Op: "Get", URL: "http://x", Err: &net.DNSError{Err: "no such host", Name: "x", IsNotFound: true}}, mnet.ERR_DNS},
+		{&url.Error{Op: "Get", URL: "http://x", Err: io.EOF}, mnet.ERR_EOF},
+		{fmt.Errorf("read body: %w", io.ErrUnexpectedEOF), mnet.ERR_EOF},
+		{errors.New("read tcp: use of closed network connection"), mnet.ERR_CLOSED},
+		{&net.OpError{Op: "write", Net: "tcp", Err: errors.New("no buffer space")}, mnet.ERR_OTHER},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.class, mnet.Classify(tc.err), "%v", tc.err)
+		assert.Equal(t, tc.class != mnet.ERR_NONE, mnet.IsNetworkError(tc.err), "%v", tc.err)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, mnet.ERR_REFUSED.Retryable(false))
+	assert.True(t, mnet.ERR_TIMEOUT.Retryable(true))
+	assert.False(t, mnet.ERR_TIMEOUT.Retryable(false))
+	assert.False(t, mnet.ERR_EOF.Retryable(false))
+	assert.False(t, mnet.ERR_TLS.Retryable(true))
+	assert.False(t, mnet.ERR_NONE.Retryable(true))
+	assert.Equal(t, "reset", mnet.ERR_RESET.String())
+
+	dialTimeout := &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	readTimeout := &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	assert.True(t, mnet.Retryable(dialTimeout, false))
+	assert.False(t, mnet.Retryable(readTimeout, false))
+	assert.True(t, mnet.Retryable(readTimeout, true))
+	assert.False(t, mnet.Retryable(errors.New("boom"), true))
+}